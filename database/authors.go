@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// ContributionsByAuthor lists the changes made by an author, newest first.
+func (db *DB) ContributionsByAuthor(name user.Name, p *Paging) ([]*Change, error) {
+	return db.ContributionsByAuthorContext(context.Background(), name, p)
+}
+
+func (db *DB) ContributionsByAuthorContext(ctx context.Context, name user.Name, p *Paging) ([]*Change, error) {
+	rows, err := db.db.QueryContext(ctx, changesSql("author=?")+p.Sql(),
+		append([]interface{}{string(name), string(name), string(name)}, p.Values()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]*Change, 0)
+	for rows.Next() {
+		c, err := scanChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// AuthorStats summarizes the contributions of an author.
+type AuthorStats struct {
+	ExtractsCreated int
+	FlavorsAdded    int
+	// UnitsEdited counts distinct units, however many times each was edited.
+	UnitsEdited int
+	// Languages are the languages of the flavors and units the author edited.
+	Languages []language.Code
+	// FirstActivity and LastActivity are zero if the author never contributed.
+	FirstActivity, LastActivity time.Time
+}
+
+// AuthorStats summarizes the contributions of an author.
+func (db *DB) AuthorStats(name user.Name) (*AuthorStats, error) {
+	return db.AuthorStatsContext(context.Background(), name)
+}
+
+func (db *DB) AuthorStatsContext(ctx context.Context, name user.Name) (*AuthorStats, error) {
+	author := string(name)
+	stats := new(AuthorStats)
+	var first, last sql.NullInt64
+	// Restores are new versions too: only the first version of an extract or flavor counts as its creation.
+	err := db.db.QueryRowContext(ctx, "select "+
+		"(select count(1) from extracts_history h where author=? and extracts_version="+
+		"(select min(extracts_version) from extracts_history where extractId=h.extractId)), "+
+		"(select count(1) from flavors_history h where author=? and flavors_version="+
+		"(select min(flavors_version) from flavors_history where extractId=h.extractId and language=h.language "+
+		"and flavorType=h.flavorType and flavorId=h.flavorId)), "+
+		"(select count(1) from (select distinct extractId, language, flavorType, flavorId, blockId, unitId "+
+		"from units_history where author=?)), "+
+		"(select min(time) from (select min(time) as time from extracts_history where author=? "+
+		"union all select min(time) from flavors_history where author=? "+
+		"union all select min(time) from units_history where author=?)), "+
+		"(select max(time) from (select max(time) as time from extracts_history where author=? "+
+		"union all select max(time) from flavors_history where author=? "+
+		"union all select max(time) from units_history where author=?))",
+		author, author, author, author, author, author, author, author, author,
+	).Scan(&stats.ExtractsCreated, &stats.FlavorsAdded, &stats.UnitsEdited, &first, &last)
+	if err != nil {
+		return nil, err
+	}
+	if first.Valid {
+		stats.FirstActivity = time.Unix(first.Int64, 0)
+	}
+	if last.Valid {
+		stats.LastActivity = time.Unix(last.Int64, 0)
+	}
+
+	rows, err := db.db.QueryContext(ctx, "select language from flavors_history where author=? "+
+		"union select language from units_history where author=? order by language", author, author)
+	if err != nil {
+		return nil, err
+	}
+	stats.Languages = make([]language.Code, 0)
+	for rows.Next() {
+		var code string
+		err := rows.Scan(&code)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.Languages = append(stats.Languages, language.Code(code))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
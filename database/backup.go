@@ -0,0 +1,293 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BackupInfo describes a backup file.
+type BackupInfo struct {
+	File   string
+	Size   int64
+	Sha256 string
+	Time   time.Time
+}
+
+const (
+	backupPrefix     = "content-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102-150405.000000"
+	// manifestSuffix is appended to backup file names to name their checksum manifests,
+	// written in the format of sha256sum.
+	manifestSuffix = ".sha256"
+)
+
+// Backup writes a consistent snapshot of the database into a new file of directory dir, along with its checksum manifest.
+// Writes wait while the snapshot is taken, reads go on.
+// If keep is positive, only the keep most recent backups of dir are kept.
+func (db *DB) Backup(dir string, keep int) (*BackupInfo, error) {
+	return db.BackupContext(context.Background(), dir, keep)
+}
+
+func (db *DB) BackupContext(ctx context.Context, dir string, keep int) (*BackupInfo, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	file := filepath.Join(dir, backupPrefix+now.Format(backupTimeFormat)+backupSuffix)
+
+	// The temporary file is only linked to its name once complete, so that backups listed in dir are never partial.
+	// Its name is unique, so that concurrent backups do not write into the same file.
+	f, err := os.CreateTemp(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	// vacuum into accepts empty files.
+	_, err = db.db.ExecContext(ctx, "vacuum into ?", tmp)
+	if err != nil {
+		return nil, err
+	}
+	sum, size, err := fileChecksum(tmp)
+	if err != nil {
+		return nil, err
+	}
+	// Unlike renaming, linking never overwrites an existing backup.
+	err = os.Link(tmp, file)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("Backup %s already exists", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(file+manifestSuffix, []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(file))), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if keep > 0 {
+		err = rotateBackups(dir, keep)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &BackupInfo{
+		File:   file,
+		Size:   size,
+		Sha256: sum,
+		Time:   now,
+	}, nil
+}
+
+func fileChecksum(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// rotateBackups removes the oldest backups of dir, and their manifests, keeping the keep most recent ones.
+func rotateBackups(dir string, keep int) error {
+	backups, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"+backupSuffix))
+	if err != nil {
+		return err
+	}
+	// Backup names sort by time.
+	sort.Strings(backups)
+	for len(backups) > keep {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		os.Remove(backups[0] + manifestSuffix)
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// verifyChecksum checks a backup file against its manifest, if there is one.
+func verifyChecksum(file string) error {
+	manifest, err := os.ReadFile(file + manifestSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(manifest))
+	if len(fields) == 0 {
+		return fmt.Errorf("Empty manifest %s", file+manifestSuffix)
+	}
+	sum, _, err := fileChecksum(file)
+	if err != nil {
+		return err
+	}
+	if sum != fields[0] {
+		return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", file, fields[0], sum)
+	}
+	return nil
+}
+
+// Restore replaces the whole content of the database with the content of a backup file.
+// The backup is checked against its manifest, if any, and its schema must match the schema of the database.
+// The backup is swapped in at once, so that readers see either the old or the restored content.
+// Writes wait for the restore, which waits for writes in progress.
+func (db *DB) Restore(file string) error {
+	return db.RestoreContext(context.Background(), file)
+}
+
+func (db *DB) RestoreContext(ctx context.Context, file string) error {
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	err := verifyChecksum(file)
+	if err != nil {
+		return err
+	}
+
+	backup, err := sql.Open("sqlite3", "file:"+file+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	err = checkBackup(ctx, db.db.DB, backup, file)
+	if err != nil {
+		return err
+	}
+
+	return db.withDatabaseLock(ctx, func() error {
+		err := swapIn(ctx, db.db.DB, backup)
+		if err != nil {
+			return err
+		}
+		// The backup may lack indexes, triggers and tables created at open.
+		_, _, err = prepare(db.db)
+		return err
+	})
+}
+
+// checkBackup checks that a backup can be restored into db.
+func checkBackup(ctx context.Context, db, backup *sql.DB, file string) error {
+	var check string
+	err := backup.QueryRowContext(ctx, "pragma quick_check").Scan(&check)
+	if err != nil {
+		return err
+	}
+	if check != "ok" {
+		return fmt.Errorf("Corrupt backup %s: %s", file, check)
+	}
+
+	// Compare with the live tables rather than the table definitions, which do not include migrated columns.
+	for _, table := range contentSchema() {
+		live, err := tableColumns(ctx, db, table.Name)
+		if err != nil {
+			return err
+		}
+		columns, err := tableColumns(ctx, backup, table.Name)
+		if err != nil {
+			return err
+		}
+		if strings.Join(columns, ",") != strings.Join(live, ",") {
+			return fmt.Errorf("Backup %s: table %s has columns %v, expected %v", file, table.Name, columns, live)
+		}
+	}
+
+	// Backups of older schemas should be opened once, to be migrated, before being restored.
+	list, err := migrationStatus(backup)
+	if err != nil {
+		return fmt.Errorf("Backup %s: %v", file, err)
+	}
+	missing := 0
+	for _, m := range list {
+		if m.Applied.IsZero() {
+			missing++
+		}
+	}
+	if missing != 0 {
+		return fmt.Errorf("Backup %s misses %d schema migrations: open it with the server to migrate it", file, missing)
+	}
+	return nil
+}
+
+// swapIn overwrites db with backup, using the online backup API of sqlite.
+// The copy is one write transaction of db, which waits for other writers.
+func swapIn(ctx context.Context, db, backup *sql.DB) error {
+	dst, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	src, err := backup.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return dst.Raw(func(dstConn interface{}) error {
+		return src.Raw(func(srcConn interface{}) error {
+			b, err := dstConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					return b.Finish()
+				}
+				// db is busy: retry until ctx is done.
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
+
+// tableColumns lists the columns of a table.
+func tableColumns(ctx context.Context, db *sql.DB, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("pragma table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make([]string, 0)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, cType string
+		var dflt interface{}
+		err := rows.Scan(&cid, &name, &cType, &notNull, &dflt, &pk)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// anyVersion disables the version check of conditional updates.
+const anyVersion = -2
+
+// VersionConflict is returned by conditional updates when the latest version differs from the expected one.
+type VersionConflict struct {
+	Expected int
+	Current  *content.Version
+}
+
+func (c *VersionConflict) Error() string {
+	return fmt.Sprintf("Version conflict: expected version %d, found version %d by %s", c.Expected, c.Current.Number, c.Current.Author)
+}
+
+type FlavorKey struct {
+	Language language.Code
+	Type     content.FlavorType
+	Id       content.FlavorId
+}
+
+type UnitKey struct {
+	FlavorKey
+	BlockId content.BlockId
+	Id      content.UnitId
+}
+
+func unitKey(u *content.Unit) UnitKey {
+	return UnitKey{
+		FlavorKey: FlavorKey{u.Language, u.FlavorType, u.FlavorId},
+		BlockId:   u.BlockId,
+		Id:        u.Id,
+	}
+}
+
+// Versions holds the latest version numbers of an extract, its flavors and their units.
+type Versions struct {
+	Extract int
+	Flavors map[FlavorKey]int
+	Units   map[UnitKey]int
+}
+
+// GetExtractWithVersions returns an extract together with the versions to pass to conditional updates.
+func (db *DB) GetExtractWithVersions(id content.ExtractId) (*content.Extract, *Versions, error) {
+	return db.GetExtractWithVersionsContext(context.Background(), id)
+}
+
+func (db *DB) GetExtractWithVersionsContext(ctx context.Context, id content.ExtractId) (*content.Extract, *Versions, error) {
+	// Versions are read before the extract: a concurrent edit then leads to a spurious conflict, rather than to a lost update.
+	v := &Versions{
+		Flavors: make(map[FlavorKey]int),
+		Units:   make(map[UnitKey]int),
+	}
+	var extractVersion sql.NullInt64
+	err := db.db.QueryRowContext(ctx, "select max(extracts_version) from extracts_history where extractId=?", string(id)).Scan(&extractVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !extractVersion.Valid {
+		return nil, nil, content.ErrNotFound
+	}
+	v.Extract = int(extractVersion.Int64)
+
+	rows, err := db.db.QueryContext(ctx, "select language, flavorType, flavorId, max(flavors_version) from flavors_history where extractId=? "+
+		"group by language, flavorType, flavorId", string(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var k FlavorKey
+		var n int
+		err = rows.Scan(&k.Language, &k.Type, &k.Id, &n)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		v.Flavors[k] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.db.QueryContext(ctx, "select language, flavorType, flavorId, blockId, unitId, max(units_version) from units_history where extractId=? "+
+		"group by language, flavorType, flavorId, blockId, unitId", string(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var k UnitKey
+		var n int
+		err = rows.Scan(&k.Language, &k.Type, &k.FlavorKey.Id, &k.BlockId, &k.Id, &n)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		v.Units[k] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	e, err := db.GetExtractContext(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, v, nil
+}
+
+// UpdateExtractIfVersion is like UpdateExtract, but fails with a *VersionConflict if the latest version of the extract is not expected.
+func (db *DB) UpdateExtractIfVersion(author user.Name, e *content.Extract, expected int) error {
+	return db.UpdateExtractIfVersionContext(context.Background(), author, e, expected)
+}
+
+func (db *DB) UpdateExtractIfVersionContext(ctx context.Context, author user.Name, e *content.Extract, expected int) error {
+	return db.updateExtract(ctx, author, e, expected)
+}
+
+// UpdateFlavorIfVersion is like UpdateFlavor, but fails with a *VersionConflict if the latest version of the flavor is not expected.
+func (db *DB) UpdateFlavorIfVersion(author user.Name, f *content.Flavor, expected int) error {
+	return db.UpdateFlavorIfVersionContext(context.Background(), author, f, expected)
+}
+
+func (db *DB) UpdateFlavorIfVersionContext(ctx context.Context, author user.Name, f *content.Flavor, expected int) error {
+	return db.updateFlavor(ctx, author, f, expected)
+}
+
+// InsertOrUpdateUnitsIfVersions is like InsertOrUpdateUnits, but fails with a *VersionConflict if the latest version
+// of a unit is not the one in expected. Units missing from expected are not checked: to require that a unit
+// does not exist yet, expect version -1. Deleted units are at the version of their deletion.
+func (db *DB) InsertOrUpdateUnitsIfVersions(author user.Name, units []*content.Unit, expected map[UnitKey]int) error {
+	return db.InsertOrUpdateUnitsIfVersionsContext(context.Background(), author, units, expected)
+}
+
+func (db *DB) InsertOrUpdateUnitsIfVersionsContext(ctx context.Context, author user.Name, units []*content.Unit, expected map[UnitKey]int) error {
+	return db.insertOrUpdateUnits(ctx, author, units, expected)
+}
+
+func (tx *Tx) checkVersion(table string, id rowKey, expected int) error {
+	if expected == anyVersion {
+		return nil
+	}
+	v, err := tx.LatestVersion(table, id)
+	if err != nil {
+		return err
+	}
+	if v.Number != expected {
+		return &VersionConflict{
+			Expected: expected,
+			Current:  v,
+		}
+	}
+	return nil
+}
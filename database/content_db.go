@@ -2,12 +2,14 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // driver import
 
@@ -19,123 +21,235 @@ import (
 )
 
 var ExtractNotFound = errors.New("Extract not found")
+var ErrSlugTaken = errors.New("Slug already in use")
+
+// SlugTakenError is returned when a slug is already used by another extract, currently or formerly.
+// It matches both ErrSlugTaken and content.ErrInvalidInput with errors.Is.
+type SlugTakenError struct {
+	Slug      string
+	ExtractId content.ExtractId
+}
+
+func (e *SlugTakenError) Error() string {
+	return fmt.Sprintf("Slug %q already used by extract %s", e.Slug, e.ExtractId)
+}
+
+func (e *SlugTakenError) Is(target error) bool {
+	return target == ErrSlugTaken || target == content.ErrInvalidInput
+}
 
 var extractIdLen = 8
 
+// SystemAuthor is the author of automatic edits, such as maintenance operations.
+const SystemAuthor = user.Name("system")
+
 type DB struct {
-	db          *database.DB
-	extractLock *lock
+	db           *database.DB
+	databaseLock *lockTable // single key, locked exclusively by restores
+	extractLocks *lockTable
+	flavorLocks  *lockTable
+	searchable   bool
+	filterable   bool // metadata conditions can be evaluated
 }
 
+// Tx is a transaction whose statements are all bound to the context it was started with.
+// Its history entries are all recorded at the time it started, so that the entries of one edit,
+// e.g. the tombstones of a deletion and of its cascade, share the same time. They also share a sequence number.
 type Tx struct {
 	*database.Tx
+	ctx  context.Context
+	time int64
+	seq  int64
+}
+
+// now is the clock of history entries.
+var now = time.Now
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(tx.ctx, query, args...)
+}
+
+var extractsTable = &database.Table{
+	Name: "extracts",
+	Columns: database.Columns{{
+		Field:      "extractId",
+		Type:       "text",
+		Constraint: "not null",
+	}, {
+		Field: "slug",
+		Type:  "text",
+	}, {
+		Field: "extractType",
+		Type:  "text",
+	}, {
+		Field: "metadata",
+		Type:  "text",
+	}},
+	PrimaryKey: []string{"extractId"},
+}
+
+var flavorsTable = &database.Table{
+	Name: "flavors",
+	Columns: database.Columns{{
+		Field: "extractId",
+		Type:  "text",
+	}, {
+		Field: "language",
+		Type:  "text",
+	}, {
+		Field: "flavorType",
+		Type:  "text",
+	}, {
+		Field: "flavorId",
+		Type:  "integer",
+	}, {
+		Field: "languageComment",
+		Type:  "text",
+	}, {
+		Field: "summary",
+		Type:  "text",
+	}},
+	PrimaryKey: []string{"extractId", "language", "flavorType", "flavorId"},
+}
+
+var unitsTable = &database.Table{
+	Name: "units",
+	Columns: database.Columns{{
+		Field: "extractId",
+		Type:  "text",
+	}, {
+		Field: "language",
+		Type:  "text",
+	}, {
+		Field: "flavorType",
+		Type:  "text",
+	}, {
+		Field: "flavorId",
+		Type:  "integer",
+	}, {
+		Field: "blockId",
+		Type:  "integer",
+	}, {
+		Field: "unitId",
+		Type:  "integer",
+	}, {
+		Field: "contentType",
+		Type:  "text",
+	}, {
+		Field: "content",
+		Type:  "text",
+	}},
+	PrimaryKey: []string{"extractId", "language", "flavorType", "flavorId", "blockId", "unitId"},
+}
+
+// contentSchema returns the tables of the content database.
+func contentSchema() database.Schema {
+	schema := database.Schema{}
+	schema = addVersionedTable(schema, extractsTable)
+	schema = addVersionedTable(schema, flavorsTable)
+	schema = addVersionedTable(schema, unitsTable)
+	schema = addVersionedTable(schema, slugAliasesTable)
+	return schema
 }
 
 func Open(file string) (*DB, error) {
-	db, err := sql.Open("sqlite3", file)
+	// Writes to different extracts may run concurrently: transactions take the write lock immediately,
+	// and wait for each other (rather than failing on a lock upgrade).
+	dsn := file + "?_txlock=immediate"
+	if strings.Contains(file, "?") {
+		dsn = file + "&_txlock=immediate"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	schema := database.Schema{}
-
-	schema = addVersionedTable(schema, &database.Table{
-		Name: "extracts",
-		Columns: database.Columns{{
-			Field:      "extractId",
-			Type:       "text",
-			Constraint: "not null",
-		}, {
-			Field: "slug",
-			Type:  "text",
-		}, {
-			Field: "extractType",
-			Type:  "text",
-		}, {
-			Field: "metadata",
-			Type:  "text",
-		}},
-		PrimaryKey: []string{"extractId"},
-	})
+	contentDB, err := database.Create(db, contentSchema())
+	if err != nil {
+		return nil, err
+	}
 
-	schema = addVersionedTable(schema, &database.Table{
-		Name: "flavors",
-		Columns: database.Columns{{
-			Field: "extractId",
-			Type:  "text",
-		}, {
-			Field: "language",
-			Type:  "text",
-		}, {
-			Field: "flavorType",
-			Type:  "text",
-		}, {
-			Field: "flavorId",
-			Type:  "integer",
-		}, {
-			Field: "languageComment",
-			Type:  "text",
-		}, {
-			Field: "summary",
-			Type:  "text",
-		}},
-		PrimaryKey: []string{"extractId", "language", "flavorType", "flavorId"},
-	})
+	err = numberHistory(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	schema = addVersionedTable(schema, &database.Table{
-		Name: "units",
-		Columns: database.Columns{{
-			Field: "extractId",
-			Type:  "text",
-		}, {
-			Field: "language",
-			Type:  "text",
-		}, {
-			Field: "flavorType",
-			Type:  "text",
-		}, {
-			Field: "flavorId",
-			Type:  "integer",
-		}, {
-			Field: "blockId",
-			Type:  "integer",
-		}, {
-			Field: "unitId",
-			Type:  "integer",
-		}, {
-			Field: "contentType",
-			Type:  "text",
-		}, {
-			Field: "content",
-			Type:  "text",
-		}},
-		PrimaryKey: []string{"extractId", "language", "flavorType", "flavorId", "blockId", "unitId"},
-	})
+	_, err = migrate(db, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	contentDB, err := database.Create(db, schema)
+	searchable, filterable, err := prepare(contentDB)
 	if err != nil {
 		return nil, err
 	}
+	if !searchable {
+		log.Println("Warning: sqlite built without FTS5, full-text search is disabled")
+	}
+	if !filterable {
+		log.Println("Warning: sqlite built without JSON1, metadata filters are disabled")
+	}
 
 	return &DB{
-		db:          contentDB,
-		extractLock: newLock(),
+		db:           contentDB,
+		databaseLock: newLockTable(),
+		extractLocks: newLockTable(),
+		flavorLocks:  newLockTable(),
+		searchable:   searchable,
+		filterable:   filterable,
 	}, nil
 }
 
+// prepare creates the indexes and search tables of an up-to-date database,
+// and tells whether it is searchable and whether its metadata can be filtered.
+func prepare(db *database.DB) (searchable, filterable bool, err error) {
+	err = createSlugIndex(db)
+	if err != nil {
+		// Old databases may contain slug collisions, which should be fixed with FixSlugCollisions.
+		log.Println("Error: could not create unique slug index:", err)
+	}
+
+	filterable, err = createMetadataIndexes(db)
+	if err != nil {
+		log.Println("Error: could not create metadata indexes:", err)
+	}
+
+	searchable, err = createSearchIndex(db)
+	return searchable, filterable, err
+}
+
 func (db *DB) Close() error {
 	return db.db.Close()
 }
 
 func (db *DB) Begin() (*Tx, error) {
-	tx, err := db.db.Begin()
+	return db.BeginContext(context.Background())
+}
+
+// BeginContext starts a transaction whose statements are bound to ctx.
+func (db *DB) BeginContext(ctx context.Context) (*Tx, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &Tx{tx}, nil
+	return &Tx{Tx: &database.Tx{Tx: tx}, ctx: ctx, time: now().Unix()}, nil
 }
 
 func (db *DB) NewExtract(author user.Name, e *content.Extract) error {
+	return db.NewExtractContext(context.Background(), author, e)
+}
+
+func (db *DB) NewExtractContext(ctx context.Context, author user.Name, e *content.Extract) error {
 	if e == nil {
 		return fmt.Errorf("New Extract should not be nil")
 	}
@@ -145,7 +259,13 @@ func (db *DB) NewExtract(author user.Name, e *content.Extract) error {
 	if !content.ValidExtractType(e.Type) {
 		return content.ErrInvalidInput
 	}
-	if valid, _ := content.ValidSlug(e.UrlSlug); !valid {
+	// Without a slug, one is suggested from the title, in the transaction inserting the extract.
+	suggest := len(e.UrlSlug) == 0
+	title, titleLang, ok := titleOf(e)
+	if suggest && !ok {
+		return content.ErrInvalidInput
+	}
+	if valid, _ := content.ValidSlug(e.UrlSlug); !suggest && !valid {
 		return content.ErrInvalidInput
 	}
 
@@ -163,22 +283,35 @@ func (db *DB) NewExtract(author user.Name, e *content.Extract) error {
 		}
 		id = content.ExtractId(strId)
 
-		err = db.withExtractLock_NoCheck(id, func() error {
-			exists, err := db.ExtractHasExisted(id)
+		err = db.withExtractLock_NoCheck(ctx, id, func() error {
+			exists, err := db.extractHasExisted(ctx, id)
 			if err != nil || exists {
 				return err
 			}
 
-			tx, err := db.Begin()
+			tx, err := db.BeginContext(ctx)
 			if err != nil {
 				return err
 			}
 
-			err = tx.InsertVersioned("extracts", author, strId, e.UrlSlug, string(e.Type), metadata)
+			if suggest {
+				e.UrlSlug, err = tx.suggestSlug(title, titleLang)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			err = tx.checkSlug(e.UrlSlug, id)
 			if err != nil {
 				tx.Rollback()
 				return err
 			}
+
+			err = tx.InsertVersioned("extracts", author, strId, e.UrlSlug, string(e.Type), metadata)
+			if err != nil {
+				tx.Rollback()
+				return slugError(err, e.UrlSlug)
+			}
 			e.SetId(id)
 
 			for lang, fByType := range e.Flavors {
@@ -201,7 +334,7 @@ func (db *DB) NewExtract(author user.Name, e *content.Extract) error {
 			}
 			return tx.Commit()
 		})
-		if err == nil {
+		if err == nil || errors.Is(err, ErrSlugTaken) {
 			break
 		}
 	}
@@ -210,6 +343,10 @@ func (db *DB) NewExtract(author user.Name, e *content.Extract) error {
 }
 
 func (db *DB) NewFlavor(author user.Name, f *content.Flavor) error {
+	return db.NewFlavorContext(context.Background(), author, f)
+}
+
+func (db *DB) NewFlavorContext(ctx context.Context, author user.Name, f *content.Flavor) error {
 	if f == nil {
 		return fmt.Errorf("New Flavor should not be nil")
 	}
@@ -223,14 +360,15 @@ func (db *DB) NewFlavor(author user.Name, f *content.Flavor) error {
 		return fmt.Errorf("Missing language field")
 	}
 
-	return db.withExtractLock(f.ExtractId, func() error {
-		tx, err := db.Begin()
+	return db.withExtractLock(ctx, f.ExtractId, func() error {
+		tx, err := db.BeginContext(ctx)
 		if err != nil {
 			return err
 		}
 
 		var max sql.NullInt64
-		err = tx.QueryRow("select max(flavorId) from flavors where extractId=? and language=? and flavorType=?",
+		// deleted flavors keep their history, so their ids cannot be reused
+		err = tx.QueryRow("select max(flavorId) from flavors_history where extractId=? and language=? and flavorType=?",
 			string(f.ExtractId), string(f.Language), string(f.Type)).Scan(&max)
 		if err != nil {
 			tx.Rollback()
@@ -261,21 +399,56 @@ func (db *DB) NewFlavor(author user.Name, f *content.Flavor) error {
 }
 
 func (db *DB) ExtractHasExisted(id content.ExtractId) (bool, error) {
-	return db.db.QueryNonZero("select count(1) from extracts_history where extractId=?", string(id))
+	return db.extractHasExisted(context.Background(), id)
+}
+
+func (db *DB) extractHasExisted(ctx context.Context, id content.ExtractId) (bool, error) {
+	return db.queryNonZero(ctx, "select count(1) from extracts_history where extractId=?", string(id))
 }
 
 func (db *DB) ExtractExists(id content.ExtractId) (bool, error) {
-	return db.db.QueryNonZero("select count(1) from extracts where extractId=?", string(id))
+	return db.extractExists(context.Background(), id)
+}
+
+func (db *DB) extractExists(ctx context.Context, id content.ExtractId) (bool, error) {
+	return db.queryNonZero(ctx, "select count(1) from extracts where extractId=?", string(id))
 }
 
 func (db *DB) FlavorExists(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) (bool, error) {
-	return db.db.QueryNonZero("select count(1) from flavors where extractId=? and language=? and flavorType=? and flavorId=?",
+	return db.flavorExists(context.Background(), extractId, lang, flavorType, flavorId)
+}
+
+func (db *DB) flavorExists(ctx context.Context, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) (bool, error) {
+	return db.queryNonZero(ctx, "select count(1) from flavors where extractId=? and language=? and flavorType=? and flavorId=?",
 		string(extractId), string(lang), string(flavorType), int(flavorId))
 }
 
+// queryNonZero is the context-aware version of database.DB.QueryNonZero.
+func (db *DB) queryNonZero(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
 func (db *DB) GetExtract(id content.ExtractId) (*content.Extract, error) {
+	return db.GetExtractContext(context.Background(), id)
+}
+
+func (db *DB) GetExtractContext(ctx context.Context, id content.ExtractId) (*content.Extract, error) {
+	return db.getExtract(ctx, id,
+		liveQuery(extractsTable), liveQuery(flavorsTable), liveQuery(unitsTable),
+		string(id))
+}
+
+// getExtract reads a whole extract using the given queries, which should select the columns of
+// the extracts, flavors and units tables (in that order) and take the same arguments.
+// Flavors and units must be sorted by primary key.
+func (db *DB) getExtract(ctx context.Context, id content.ExtractId, extractQuery, flavorQuery, unitQuery string, args ...interface{}) (*content.Extract, error) {
 	strId := string(id)
-	e, err := db.scanExtract(db.db.QueryRow("select * from extracts where extractId=?", strId))
+	e, err := db.scanExtract(db.db.QueryRowContext(ctx, extractQuery, args...))
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, content.ErrNotFound
@@ -284,7 +457,7 @@ func (db *DB) GetExtract(id content.ExtractId) (*content.Extract, error) {
 	default:
 	}
 
-	rows, err := db.db.Query("select * from flavors where extractId=? order by extractId, language, flavorType, flavorId", strId)
+	rows, err := db.db.QueryContext(ctx, flavorQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -293,7 +466,7 @@ func (db *DB) GetExtract(id content.ExtractId) (*content.Extract, error) {
 		return nil, err
 	}
 
-	rows, err = db.db.Query("select * from units where extractId=? order by extractId, language, flavorType, flavorId, blockId, unitId", strId)
+	rows, err = db.db.QueryContext(ctx, unitQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -469,7 +642,7 @@ func (db *DB) SlugToIdMap() (map[string]content.ExtractId, error) {
 		}
 		slug = strings.ToLower(slug)
 		if otherId, wasThere := m[slug]; wasThere {
-			log.Println("Error: slug used by both %v and %v", id, otherId)
+			log.Printf("Error: slug %s used by both %v and %v", slug, id, otherId)
 		}
 		m[slug] = content.ExtractId(id)
 	}
@@ -478,3 +651,13 @@ func (db *DB) SlugToIdMap() (map[string]content.ExtractId, error) {
 	}
 	return m, nil
 }
+
+// ExtractSlug returns the slug of an extract.
+func (db *DB) ExtractSlug(id content.ExtractId) (string, error) {
+	var slug string
+	err := db.db.QueryRow("select slug from extracts where extractId=?", string(id)).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return "", content.ErrNotFound
+	}
+	return slug, err
+}
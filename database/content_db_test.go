@@ -1,10 +1,23 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/polyglottis/platform/content"
 	"github.com/polyglottis/platform/content/test"
+	"github.com/polyglottis/platform/database"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
 )
 
 var testDB = "content_test.db"
@@ -26,3 +39,1917 @@ func TestAll(t *testing.T) {
 	tester := test.NewTester(db, t)
 	tester.All()
 }
+
+func openTestDB(t *testing.T) *DB {
+	os.Remove(testDB)
+	db, err := Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func closeTestDB(db *DB) {
+	db.Close()
+	os.Remove(testDB)
+}
+
+// insertTestExtract inserts an extract with one flavor directly, bypassing input validation.
+func insertTestExtract(t *testing.T, db *DB, id content.ExtractId, slug string, blocks content.BlockSlice) *content.Flavor {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, string(id), slug, "testType", []byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &content.Flavor{
+		ExtractId: id,
+		Language:  "en",
+		Type:      "testFlavor",
+		Id:        1,
+		Summary:   "summary",
+		Blocks:    blocks,
+	}
+	err = tx.InsertVersionedFlavor(testAuthor, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// updateTestUnit updates a unit directly, bypassing input validation.
+func updateTestUnit(t *testing.T, db *DB, f *content.Flavor, blockId content.BlockId, unitId content.UnitId, c string) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("units", testAuthor, newUnitId(f.ExtractId, f.Language, f.Type, f.Id, blockId, unitId),
+		&unitUpdate{Content: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testUnits(contents ...string) content.BlockSlice {
+	blocks := make(content.BlockSlice, len(contents))
+	for i, c := range contents {
+		blocks[i] = content.UnitSlice{{Content: c}}
+	}
+	return blocks
+}
+
+var testAuthor = user.Name("tester")
+
+func TestHistory(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "body"))
+	for i := 0; i < 3; i++ {
+		f.Summary = fmt.Sprintf("summary %d", i)
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.InsertOrUpdateVersioned("flavors", user.Name(fmt.Sprintf("author%d", i)), newFlavorId(f.ExtractId, f.Language, f.Type, f.Id),
+			&flavorUpdate{Summary: f.Summary})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+
+	versions, err := db.FlavorHistory(f.ExtractId, f.Language, f.Type, f.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 {
+		t.Fatalf("Expected 4 versions, got %d", len(versions))
+	}
+	for i, v := range versions {
+		if v.Number != 3-i {
+			t.Errorf("Versions should be sorted newest first, got %d at position %d", v.Number, i)
+		}
+	}
+	if versions[0].Author != "author2" || versions[0].EditType != content.EditUpdate {
+		t.Errorf("Unexpected latest version: %+v", versions[0])
+	}
+	if versions[3].Author != testAuthor || versions[3].EditType != content.EditNew {
+		t.Errorf("Unexpected first version: %+v", versions[3])
+	}
+
+	versions, err = db.FlavorHistory(f.ExtractId, f.Language, f.Type, f.Id, &Paging{Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Number != 2 || versions[1].Number != 1 {
+		t.Errorf("Unexpected page: %v", versions)
+	}
+
+	versions, err = db.ExtractHistory(f.ExtractId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("Expected 1 extract version, got %d", len(versions))
+	}
+
+	versions, err = db.UnitHistory(f.ExtractId, f.Language, f.Type, f.Id, 2, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("Expected 1 unit version, got %d", len(versions))
+	}
+}
+
+// backdate moves all history entries of the given version back in time.
+func backdate(t *testing.T, db *DB, table string, number int, d time.Duration) {
+	_, err := db.db.Exec(fmt.Sprintf("update %s set time=time-? where %s=?", history(table), version(table)), int64(d/time.Second), number)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetExtractAt(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "old body"))
+	for _, table := range []string{"extracts", "flavors", "units"} {
+		backdate(t, db, table, 0, time.Hour)
+	}
+
+	updateTestUnit(t, db, f, 2, 1, "new body")
+
+	body := func(e *content.Extract) string {
+		return e.Flavors[f.Language][f.Type][0].Blocks[1][0].Content
+	}
+
+	e, err := db.GetExtractAt(f.ExtractId, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body(e) != "old body" {
+		t.Errorf("Expected old body, got %q", body(e))
+	}
+
+	e, err = db.GetExtractAt(f.ExtractId, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, live) {
+		t.Errorf("Current historic read should equal live read: %+v != %+v", e, live)
+	}
+
+	_, err = db.GetExtractAt(f.ExtractId, time.Now().Add(-2*time.Hour))
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound before creation, got %v", err)
+	}
+
+	e, err = db.GetExtractAtVersion(f.ExtractId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body(e) != "old body" {
+		t.Errorf("Expected old body at version 0, got %q", body(e))
+	}
+
+	// Edits made later in the same second do not belong to a version.
+	defer func(saved func() time.Time) { now = saved }(now)
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("extracts", testAuthor, newExtractId(f.ExtractId), &extractUpdate{
+		Slug:        "slug1",
+		ExtractType: "poem",
+		Metadata:    []byte("null"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateTestUnit(t, db, f, 2, 1, "newest body")
+
+	e, err = db.GetExtractAtVersion(f.ExtractId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "poem" || body(e) != "new body" {
+		t.Errorf("Expected type poem and new body at version 1, got %q and %q", e.Type, body(e))
+	}
+	e, err = db.GetExtractAt(f.ExtractId, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body(e) != "newest body" {
+		t.Errorf("Reads at a time should include all edits of that second, got %q", body(e))
+	}
+}
+
+func TestNumberHistory(t *testing.T) {
+	os.Remove(testDB)
+	defer os.Remove(testDB)
+
+	// Databases created before sequence numbers have history without them.
+	old, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.Create(old, contentSchema())
+	if err == nil {
+		for _, stmt := range []string{
+			"insert into extracts values ('a','slug-a','testType','null')",
+			"insert into extracts_history values ('a','slug-a','testType','null','tester',10,0,'new')",
+			"insert into extracts_history values ('a','slug-a','other','null','tester',20,1,'update')",
+			"insert into flavors_history values ('a','en','text',1,'','','tester',10,0,'new')",
+		} {
+			if _, err = old.Exec(stmt); err != nil {
+				break
+			}
+		}
+	}
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var seqs []int64
+	for _, table := range []string{"extracts_history", "flavors_history"} {
+		rows, err := db.db.Query("select seq from " + table + " order by time")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var seq int64
+			if err := rows.Scan(&seq); err != nil {
+				t.Fatal(err)
+			}
+			seqs = append(seqs, seq)
+		}
+		rows.Close()
+	}
+	if expected := []int64{1, 2, 1}; !reflect.DeepEqual(seqs, expected) {
+		t.Errorf("Entries should be numbered by time: expected %v, got %v", expected, seqs)
+	}
+
+	updateTestUnit(t, db, &content.Flavor{ExtractId: "a", Language: "en", Type: "text", Id: 1}, 1, 1, "unit")
+	var seq int64
+	err = db.db.QueryRow("select seq from units_history").Scan(&seq)
+	if err != nil || seq != 3 {
+		t.Errorf("New entries should be numbered after earlier ones, got %d, %v", seq, err)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "first"))
+	updateTestUnit(t, db, f, 2, 1, "second")
+
+	err := db.RevertUnit(testAuthor, f.ExtractId, f.Language, f.Type, f.Id, 2, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := e.Flavors[f.Language][f.Type][0].Blocks[1][0].Content; c != "first" {
+		t.Errorf("Expected reverted content, got %q", c)
+	}
+	versions, err := db.UnitHistory(f.ExtractId, f.Language, f.Type, f.Id, 2, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].EditType != EditRevert {
+		t.Errorf("Revert should be recorded in history: %v", versions)
+	}
+
+	err = db.RevertUnit(testAuthor, f.ExtractId, f.Language, f.Type, f.Id, 2, 1, 7)
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing version, got %v", err)
+	}
+
+	f.Summary = "changed"
+	f.LanguageComment = "comment"
+	err = db.UpdateFlavor(testAuthor, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RevertFlavor(testAuthor, f.ExtractId, f.Language, f.Type, f.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted := e.Flavors[f.Language][f.Type][0]; reverted.Summary != "summary" || reverted.LanguageComment != "" {
+		t.Errorf("Unexpected reverted flavor: %+v", reverted)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("extracts", testAuthor, newExtractId(f.ExtractId), &extractUpdate{
+		Slug:        "slug2",
+		ExtractType: "poem",
+		Metadata:    []byte(`{"Author":"someone"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RevertExtract(testAuthor, f.ExtractId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "testType" || e.Metadata != nil {
+		t.Errorf("Expected reverted type and metadata, got %q and %+v", e.Type, e.Metadata)
+	}
+	if e.UrlSlug != "slug2" {
+		t.Errorf("Revert should keep the slug, got %q", e.UrlSlug)
+	}
+	versions, err = db.ExtractHistory(f.ExtractId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Number != 2 || versions[0].EditType != EditRevert || versions[0].Author != testAuthor {
+		t.Errorf("Extract revert should be recorded in history: %+v", versions[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.RevertUnitContext(ctx, testAuthor, f.ExtractId, f.Language, f.Type, f.Id, 2, 1, 1)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestFlavorUpdate checks that flavor updates write the language comment and summary into their own columns,
+// both when inserting and when updating a flavor.
+func TestFlavorUpdate(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title"))
+	for i, id := range []*primaryKey{newFlavorId(f.ExtractId, "fr", f.Type, 1), newFlavorId(f.ExtractId, f.Language, f.Type, f.Id)} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.InsertOrUpdateVersioned("flavors", testAuthor, id, &flavorUpdate{
+			LanguageComment: fmt.Sprintf("comment %d", i),
+			Summary:         fmt.Sprintf("summary %d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := db.GetExtract(f.ExtractId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := e.Flavors[language.Code(id.Language)][f.Type][0]
+		if got.LanguageComment != fmt.Sprintf("comment %d", i) || got.Summary != fmt.Sprintf("summary %d", i) {
+			t.Errorf("Flavor %d: unexpected language comment %q and summary %q", i, got.LanguageComment, got.Summary)
+		}
+	}
+}
+
+func TestDiffWords(t *testing.T) {
+	diff := diffWords("the quick brown fox jumps", "the slow brown fox jumps high")
+	expected := []*WordDiff{
+		{WordEqual, "the"},
+		{WordRemoved, "quick"},
+		{WordAdded, "slow"},
+		{WordEqual, "brown fox jumps"},
+		{WordAdded, "high"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		for _, d := range diff {
+			t.Logf("%+v", d)
+		}
+		t.Error("Unexpected word diff")
+	}
+}
+
+func TestDiffFlavor(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "a b c", "removed"))
+	for _, table := range []string{"extracts", "flavors", "units"} {
+		backdate(t, db, table, 0, time.Hour)
+	}
+	updateTestUnit(t, db, f, 2, 1, "a x c")
+	updateTestUnit(t, db, f, 4, 1, "added")
+	_, err := db.db.Exec("delete from units where blockId=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := db.DiffFlavor(f.ExtractId, f.Language, f.Type, f.Id, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Blocks) != 3 {
+		t.Fatalf("Expected 3 changed blocks, got %d", len(diff.Blocks))
+	}
+	if b := diff.Blocks[0]; b.BlockId != 2 || len(b.Changed) != 1 || len(b.Changed[0].Words) != 4 {
+		t.Errorf("Unexpected change in block 2: %+v", b)
+	}
+	if b := diff.Blocks[1]; b.BlockId != 3 || len(b.Removed) != 1 || b.Removed[0].Content != "removed" {
+		t.Errorf("Unexpected change in block 3: %+v", b)
+	}
+	if b := diff.Blocks[2]; b.BlockId != 4 || len(b.Added) != 1 || b.Added[0].Content != "added" {
+		t.Errorf("Unexpected change in block 4: %+v", b)
+	}
+
+	// Unit edits are revisions of the flavor, even within the same second.
+	defer func(saved func() time.Time) { now = saved }(now)
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	updateTestUnit(t, db, f, 1, 1, "new title")
+	updateTestUnit(t, db, f, 1, 1, "newer title")
+	revisions, err := db.FlavorRevisions(f.ExtractId, f.Language, f.Type, f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 5 || revisions[0].EditType != content.EditNew || revisions[4].Number != 4 {
+		t.Fatalf("Unexpected revisions: %+v", revisions)
+	}
+	diff, err = db.DiffFlavor(f.ExtractId, f.Language, f.Type, f.Id, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Blocks) != 1 || len(diff.Blocks[0].Changed) != 1 ||
+		diff.Blocks[0].Changed[0].From.Content != "new title" || diff.Blocks[0].Changed[0].To.Content != "newer title" {
+		t.Errorf("Unexpected diff between intermediate revisions: %+v", diff.Blocks)
+	}
+	diff, err = db.DiffFlavor(f.ExtractId, f.Language, f.Type, f.Id, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Blocks) != 1 || diff.Blocks[0].BlockId != 4 || len(diff.Blocks[0].Added) != 1 {
+		t.Errorf("Unexpected diff between intermediate revisions: %+v", diff.Blocks)
+	}
+	_, err = db.DiffFlavor(f.ExtractId, f.Language, f.Type, f.Id, 0, 5)
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing revision, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "a", "b"))
+	insertTestExtract(t, db, "extract2", "slug2", testUnits("title"))
+
+	err := db.DeleteUnits(testAuthor, []*content.Unit{{
+		ExtractId:  f.ExtractId,
+		Language:   f.Language,
+		FlavorType: f.Type,
+		FlavorId:   f.Id,
+		BlockId:    3,
+		Id:         1,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.Flavors[f.Language][f.Type][0].Blocks); n != 2 {
+		t.Errorf("Expected 2 blocks after unit deletion, got %d", n)
+	}
+
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetExtract(f.ExtractId)
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after deletion, got %v", err)
+	}
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound when deleting twice, got %v", err)
+	}
+
+	for _, table := range []string{"flavors", "units"} {
+		exist, err := db.db.QueryNonZero("select count(1) from "+table+" where extractId=?", string(f.ExtractId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exist {
+			t.Errorf("Deleting an extract should delete its %s", table)
+		}
+	}
+
+	versions, err := db.UnitHistory(f.ExtractId, f.Language, f.Type, f.Id, 2, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].EditType != content.EditDelete {
+		t.Errorf("Deletion should leave a tombstone: %v", versions)
+	}
+
+	m, err := db.SlugToIdMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["slug1"]; ok || len(m) != 1 {
+		t.Errorf("Deleted extract should not be in slug map: %v", m)
+	}
+	list, err := db.ExtractListWithLanguage(f.Language)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "extract2" {
+		t.Errorf("Deleted extract should not be listed: %v", list)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.DeleteExtractContext(ctx, testAuthor, "extract2")
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	err = db.RestoreExtractContext(ctx, testAuthor, f.ExtractId)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "body"))
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &content.Flavor{ExtractId: f.ExtractId, Language: "fr", Type: f.Type, Id: 1, Blocks: testUnits("titre")}
+	err = tx.InsertVersionedFlavor(testAuthor, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	err = db.DeleteFlavor(testAuthor, g.ExtractId, g.Language, g.Type, g.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, db, "flavors", 1, time.Hour)
+	backdate(t, db, "units", 1, time.Hour)
+
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTestExtract(t, db, "extract2", "SLUG1", nil)
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("Expected ErrSlugTaken, got %v", err)
+	}
+	err = db.DeleteExtract(testAuthor, "extract2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.UrlSlug != "slug1" || len(e.Flavors) != 1 || len(e.Flavors[f.Language][f.Type][0].Blocks) != 2 {
+		t.Errorf("Unexpected restored extract: %+v", e)
+	}
+	versions, err := db.ExtractHistory(f.ExtractId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions[0].EditType != content.EditNew {
+		t.Errorf("Restoring should record a new version: %v", versions[0])
+	}
+
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if err != content.ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput when restoring a live extract, got %v", err)
+	}
+
+	err = db.RestoreFlavor(testAuthor, g.ExtractId, g.Language, g.Type, g.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := e.Flavors[g.Language][g.Type]; len(restored) != 1 || len(restored[0].Blocks) != 1 {
+		t.Errorf("Unexpected restored flavor: %v", restored)
+	}
+}
+
+// TestRestoreCascade checks that restoring finds the whole cascade of a deletion,
+// even if the clock ticks while the tombstones are written.
+func TestRestoreCascade(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "body"))
+	defer func(saved func() time.Time) { now = saved }(now)
+	clock := time.Now()
+	now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	err := db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times int
+	err = db.db.QueryRow("select count(distinct time) from (select time from extracts_history where editType=? "+
+		"union all select time from flavors_history where editType=? union all select time from units_history where editType=?)",
+		content.EditDelete, content.EditDelete, content.EditDelete).Scan(&times)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times != 1 {
+		t.Errorf("The tombstones of a deletion should share their time, got %d times", times)
+	}
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Flavors) != 1 || len(e.Flavors[f.Language][f.Type][0].Blocks) != 2 {
+		t.Errorf("Unexpected restored extract: %+v", e)
+	}
+
+	err = db.DeleteFlavor(testAuthor, f.ExtractId, f.Language, f.Type, f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RestoreFlavor(testAuthor, f.ExtractId, f.Language, f.Type, f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Flavors) != 1 || len(e.Flavors[f.Language][f.Type][0].Blocks) != 2 {
+		t.Errorf("Unexpected restored flavor: %+v", e)
+	}
+
+	// Units deleted separately earlier in the same second stay deleted.
+	stopped := time.Now()
+	now = func() time.Time { return stopped }
+	err = db.DeleteUnits(testAuthor, []*content.Unit{{
+		ExtractId: f.ExtractId, Language: f.Language, FlavorType: f.Type, FlavorId: f.Id, BlockId: 2, Id: 1,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Flavors) != 1 || len(e.Flavors[f.Language][f.Type][0].Blocks) != 1 {
+		t.Errorf("Restoring the extract should not restore the unit deleted before: %+v", e)
+	}
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title", "body"))
+	_, versions, err := db.GetExtractWithVersions(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fKey := FlavorKey{f.Language, f.Type, f.Id}
+	uKey := UnitKey{fKey, 2, 1}
+	if versions.Extract != 0 || versions.Flavors[fKey] != 0 || versions.Units[uKey] != 0 || len(versions.Units) != 2 {
+		t.Fatalf("Unexpected versions: %+v", versions)
+	}
+
+	f.Summary = "first edit"
+	err = db.UpdateFlavorIfVersion(testAuthor, f, versions.Flavors[fKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Summary = "concurrent edit"
+	err = db.UpdateFlavorIfVersion(user.Name("other"), f, versions.Flavors[fKey])
+	if conflict, ok := err.(*VersionConflict); !ok || conflict.Expected != 0 || conflict.Current.Number != 1 {
+		t.Errorf("Expected version conflict, got %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.checkVersion("units", newUnitId(f.ExtractId, f.Language, f.Type, f.Id, 3, 1), -1)
+	if err != nil {
+		t.Errorf("A missing unit should be at version -1, got %v", err)
+	}
+	err = tx.checkVersion("units", newUnitId(f.ExtractId, f.Language, f.Type, f.Id, 2, 1), -1)
+	if _, ok := err.(*VersionConflict); !ok {
+		t.Errorf("Expected version conflict for an existing unit, got %v", err)
+	}
+	tx.Rollback()
+
+	_, _, err = db.GetExtractWithVersions("missing")
+	if err != content.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Deleted units can be recreated, whether or not the client knows of their deletion.
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &content.Flavor{ExtractId: f.ExtractId, Language: "fr", Type: "text", Id: 1, Blocks: testUnits("titre", "corps")}
+	err = tx.InsertVersionedFlavor(testAuthor, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &content.Unit{ExtractId: g.ExtractId, Language: g.Language, FlavorType: g.Type, FlavorId: g.Id, BlockId: 2, Id: 1, Content: "corps"}
+	err = db.DeleteUnits(testAuthor, []*content.Unit{body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, versions, err = db.GetExtractWithVersions(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertOrUpdateUnitsIfVersions(testAuthor, []*content.Unit{body}, versions.Units)
+	if err != nil {
+		t.Errorf("Recreating a deleted unit at its current version should succeed, got %v", err)
+	}
+	err = db.DeleteUnits(testAuthor, []*content.Unit{body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertOrUpdateUnitsIfVersions(testAuthor, []*content.Unit{body}, nil)
+	if err != nil {
+		t.Errorf("Units missing from expected should not be checked, got %v", err)
+	}
+	err = db.InsertOrUpdateUnitsIfVersions(testAuthor, []*content.Unit{body}, map[UnitKey]int{unitKey(body): -1})
+	if _, ok := err.(*VersionConflict); !ok {
+		t.Errorf("Expected version conflict for an existing unit, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.UpdateFlavorIfVersionContext(ctx, testAuthor, g, 0)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRenameSlug(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	insertTestExtract(t, db, "extract1", "first-slug", nil)
+	insertTestExtract(t, db, "extract2", "other-slug", nil)
+
+	err := db.RenameSlug(testAuthor, "extract1", "Other-Slug")
+	if !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("Expected ErrSlugTaken, got %v", err)
+	}
+	err = db.RenameSlug(testAuthor, "extract1", "second-slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RenameSlug(testAuthor, "extract2", "first-slug")
+	if !errors.Is(err, ErrSlugTaken) {
+		t.Errorf("Former slugs should stay reserved, got %v", err)
+	}
+
+	slug, err := db.ExtractSlug("extract1")
+	if err != nil || slug != "second-slug" {
+		t.Errorf("Expected renamed slug, got %v, %v", slug, err)
+	}
+	aliases, err := db.SlugAliasMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases["first-slug"] != "extract1" {
+		t.Errorf("Unexpected aliases: %v", aliases)
+	}
+
+	// renaming back drops the alias
+	err = db.RenameSlug(testAuthor, "extract1", "First-Slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, err = db.SlugAliasMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases["second-slug"] != "extract1" {
+		t.Errorf("Unexpected aliases: %v", aliases)
+	}
+	versions, err := db.ExtractHistory("extract1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Errorf("Renames should be versioned, got %d versions", len(versions))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.RenameSlugContext(ctx, testAuthor, "extract1", "third-slug")
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSlugCollisions(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	insertTestExtract(t, db, "extract1", "slug", nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, "extract2", "Slug", "testType", []byte("null"))
+	if !errors.Is(slugError(err, "Slug"), ErrSlugTaken) {
+		t.Errorf("The unique index should reject duplicate slugs, got %v", err)
+	}
+	tx.Rollback()
+
+	// simulate an old database
+	_, err = db.db.Exec("drop index extracts_lower_slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestExtract(t, db, "extract2", "Slug", nil)
+	backdate(t, db, "extracts", 0, time.Hour) // extract3 is the newest
+	insertTestExtract(t, db, "extract3", "SLUG", nil)
+	insertTestExtract(t, db, "extract4", "slug-2", nil)
+
+	collisions, err := db.SlugCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collisions) != 1 || len(collisions[0].ExtractIds) != 3 {
+		t.Fatalf("Unexpected collisions: %v", collisions)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.FixSlugCollisionsContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	collisions, err = db.FixSlugCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := collisions[0]; len(c.Renamed) != 2 || c.ExtractIds[0] == "extract3" || c.Renamed["extract3"] != "SLUG-4" {
+		t.Errorf("Unexpected fix: %+v", c)
+	}
+	collisions, err = db.SlugCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collisions) != 0 {
+		t.Errorf("Collisions should be fixed: %v", collisions)
+	}
+	_, err = db.db.Exec("drop index extracts_lower_slug")
+	if err != nil {
+		t.Errorf("Fixing collisions should create the unique index: %v", err)
+	}
+}
+
+func TestExtractsPage(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	insertTestExtract(t, db, "b", "slug-b", testUnits("title"))
+	backdate(t, db, "extracts", 0, time.Hour)
+	a := insertTestExtract(t, db, "a", "Slug-a", testUnits("title"))
+	insertTestExtract(t, db, "c", "slug-c", nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersionedFlavor(testAuthor, &content.Flavor{ExtractId: a.ExtractId, Language: "fr", Type: a.Type, Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	for _, test := range []struct {
+		q    content.Query
+		opts *ListOptions
+		ids  []content.ExtractId
+	}{
+		{content.Query{}, nil, []content.ExtractId{"a", "b", "c"}},
+		{content.Query{}, &ListOptions{Descending: true}, []content.ExtractId{"c", "b", "a"}},
+		{content.Query{}, &ListOptions{Sort: SortByCreated}, []content.ExtractId{"b", "a", "c"}},
+		{content.Query{}, &ListOptions{Sort: SortByLanguages, Descending: true}, []content.ExtractId{"a", "b", "c"}},
+		{content.Query{}, &ListOptions{Paging: Paging{Offset: 1, Limit: 1}}, []content.ExtractId{"b"}},
+		{content.Query{LanguageA: "fr"}, nil, []content.ExtractId{"a"}},
+		{content.Query{LanguageB: "fr", LanguageA: "en"}, nil, []content.ExtractId{"a"}},
+		{content.Query{ExtractType: "otherType"}, nil, []content.ExtractId{}},
+	} {
+		page, err := db.ExtractsPage(&test.q, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page.Ids, test.ids) {
+			t.Errorf("Query %+v with options %+v: expected %v, got %v", test.q, test.opts, test.ids, page.Ids)
+		}
+		if test.opts == nil && page.Total != len(test.ids) {
+			t.Errorf("Query %+v: expected total %d, got %d", test.q, len(test.ids), page.Total)
+		}
+	}
+
+	page, err := db.ExtractsPage(&content.Query{}, &ListOptions{Paging: Paging{Limit: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Ids) != 2 {
+		t.Errorf("Unexpected page: %+v", page)
+	}
+
+	_, err = db.ExtractsPage(&content.Query{}, &ListOptions{Sort: "unknown"})
+	if err != content.ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for an unknown sort key, got %v", err)
+	}
+}
+
+func TestExtractFilter(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title"))
+	insertTestExtract(t, db, "b", "slug-b", nil)
+	backdate(t, db, "extracts", 0, 2*time.Hour)
+	backdate(t, db, "flavors", 0, 2*time.Hour)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range []language.Code{"fr", "de"} {
+		err = tx.InsertVersionedFlavor("other", &content.Flavor{ExtractId: a.ExtractId, Language: lang, Type: "otherFlavor", Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Commit()
+
+	for _, test := range []struct {
+		f   *ExtractFilter
+		ids []content.ExtractId
+	}{
+		{nil, []content.ExtractId{"a", "b"}},
+		{&ExtractFilter{ExtractType: "testType"}, []content.ExtractId{"a", "b"}},
+		{&ExtractFilter{ExtractType: "otherType"}, []content.ExtractId{}},
+		{&ExtractFilter{Languages: []language.Code{"en", "fr", "de"}}, []content.ExtractId{"a"}},
+		{&ExtractFilter{Languages: []language.Code{"en", "es"}}, []content.ExtractId{}},
+		{&ExtractFilter{Languages: []language.Code{"en", ""}}, []content.ExtractId{"a", "b"}},
+		{&ExtractFilter{FlavorType: "otherFlavor"}, []content.ExtractId{"a"}},
+		{&ExtractFilter{Languages: []language.Code{"en", "fr"}, FlavorType: "otherFlavor"}, []content.ExtractId{}},
+		{&ExtractFilter{Languages: []language.Code{"fr", "de"}, FlavorType: "otherFlavor"}, []content.ExtractId{"a"}},
+		{&ExtractFilter{Author: "other"}, []content.ExtractId{"a"}},
+		{&ExtractFilter{Author: testAuthor}, []content.ExtractId{"a", "b"}},
+		{&ExtractFilter{ModifiedSince: time.Now().Add(-time.Hour)}, []content.ExtractId{"a"}},
+		{&ExtractFilter{ModifiedBefore: time.Now().Add(-time.Hour)}, []content.ExtractId{"b"}},
+	} {
+		list, err := db.FilteredExtractList(test.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]content.ExtractId, 0, len(list))
+		for _, e := range list {
+			ids = append(ids, e.Id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Filter %+v: expected %v, got %v", test.f, test.ids, ids)
+		}
+
+		page, err := db.FilteredExtractsPage(test.f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page.Ids, test.ids) {
+			t.Errorf("Filter %+v: expected page %v, got %v", test.f, test.ids, page.Ids)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	f := insertTestExtract(t, db, "a", "slug-a", testUnits("Le petit chat", "Un chien et un chat"))
+	_, err := db.Search("chat", "en", 0)
+	if err == ErrSearchUnavailable {
+		t.Skip(err)
+	}
+	insertTestExtract(t, db, "b", "slug-b", testUnits("Le café"))
+
+	search := func(query string, expected ...string) {
+		results, err := db.Search(query, "en", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make([]string, 0)
+		for _, r := range results {
+			found = append(found, fmt.Sprintf("%s/%d", r.ExtractId, r.BlockId))
+		}
+		sort.Strings(found)
+		if expected == nil {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("Search %q: expected %v, got %v", query, expected, found)
+		}
+	}
+	search("chat", "a/1", "a/2")
+	search("chien chat", "a/2")
+	search("CAFE", "b/1")
+	search("pet*", "a/1")
+	search(`"don't`)
+
+	updateTestUnit(t, db, f, 1, 1, "Le grand chien")
+	search("chat", "a/2")
+	search("chien", "a/1", "a/2")
+
+	results, err := db.Search("chien", "fr", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no results in another language, got %v", results)
+	}
+
+	results, err = db.Search("grand", "en", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SnippetPart{{Text: "Le "}, {Text: "grand", Highlight: true}, {Text: " chien"}}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Snippet, expected) {
+		t.Errorf("Expected snippet %v, got %v", expected, results)
+	}
+
+	// The index does not depend on the rowids of units, which may change, e.g. after a VACUUM.
+	for _, stmt := range []string{"drop trigger units_search_update", "update units set rowid=rowid+100"} {
+		_, err = db.db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = createSearchIndex(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &content.Flavor{ExtractId: "b", Language: f.Language, Type: f.Type, Id: f.Id}
+	updateTestUnit(t, db, g, 1, 1, "Le thé")
+	search("café")
+	search("thé", "b/1")
+	search("chien", "a/1", "a/2")
+	updateTestUnit(t, db, g, 1, 1, "Le café")
+
+	err = db.DeleteExtract(testAuthor, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	search("chien")
+
+	err = db.RebuildSearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	search("café", "b/1")
+
+	_, err = db.Search(" * ", "en", 0)
+	if err != content.ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for an empty query, got %v", err)
+	}
+}
+
+func TestMetadataFilter(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, metadata := range map[string]string{
+		"a": `{"Author":"Tolstoy","Year":1869}`,
+		"b": `{"Author":"Pushkin","Year":1833,"Difficulty":2}`,
+		"c": `null`,
+	} {
+		err = tx.InsertVersioned("extracts", testAuthor, id, "slug-"+id, "testType", []byte(metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Commit()
+
+	for _, test := range []struct {
+		conds []MetadataCondition
+		ids   []content.ExtractId
+	}{
+		{[]MetadataCondition{{Key: "Author", Value: "Tolstoy"}}, []content.ExtractId{"a"}},
+		{[]MetadataCondition{{Key: "Author", Op: MetadataNotEqual, Value: "Tolstoy"}}, []content.ExtractId{"b"}},
+		{[]MetadataCondition{{Key: "Year", Op: MetadataLess, Value: 1850}}, []content.ExtractId{"b"}},
+		{[]MetadataCondition{{Key: "Year", Op: MetadataGreaterOrEqual, Value: 1800}}, []content.ExtractId{"a", "b"}},
+		{[]MetadataCondition{{Key: "Year", Value: "1869"}}, []content.ExtractId{}},
+		{[]MetadataCondition{{Key: "Year", Op: MetadataGreater, Value: 1800}, {Key: "Difficulty", Value: 2}}, []content.ExtractId{"b"}},
+	} {
+		page, err := db.FilteredExtractsPage(&ExtractFilter{Metadata: test.conds}, nil)
+		if !db.filterable {
+			if err != ErrMetadataUnavailable {
+				t.Errorf("Conditions %+v: sqlite built without JSON1, expected ErrMetadataUnavailable, got %v", test.conds, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page.Ids, test.ids) {
+			t.Errorf("Conditions %+v: expected %v, got %v", test.conds, test.ids, page.Ids)
+		}
+	}
+
+	for _, c := range []MetadataCondition{
+		{Key: "Year') or 1=1 --", Value: 1},
+		{Key: "Year", Op: "like", Value: 1},
+		{Key: "Year", Value: []int{1}},
+	} {
+		_, err := db.FilteredExtractList(&ExtractFilter{Metadata: []MetadataCondition{c}})
+		if err != content.ErrInvalidInput {
+			t.Errorf("Condition %+v: expected ErrInvalidInput, got %v", c, err)
+		}
+	}
+
+	if !db.filterable {
+		_, err := db.Facets(&ExtractFilter{Metadata: []MetadataCondition{{Key: "Year", Value: 1869}}})
+		if err != ErrMetadataUnavailable {
+			t.Errorf("Expected ErrMetadataUnavailable, got %v", err)
+		}
+		return
+	}
+	query, args, err := (&ExtractFilter{Metadata: []MetadataCondition{{Key: "Year", Value: 1869}}}).Sql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan string
+	rows, err := db.db.Query("explain query plan "+query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan += detail + "\n"
+	}
+	if !strings.Contains(plan, "extracts_metadata_Year") {
+		t.Errorf("Expected the metadata index to be used, got plan:\n%s", plan)
+	}
+}
+
+func TestFacets(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", nil)
+	insertTestExtract(t, db, "b", "slug-b", nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, "c", "slug-c", "otherType", []byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range []language.Code{"fr", "de"} {
+		err = tx.InsertVersionedFlavor(testAuthor, &content.Flavor{ExtractId: a.ExtractId, Language: lang, Type: "otherFlavor", Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.InsertVersionedFlavor(testAuthor, &content.Flavor{ExtractId: a.ExtractId, Language: "fr", Type: "testFlavor", Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	facets, err := db.Facets(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Facets{
+		Total:         3,
+		Languages:     map[language.Code]int{"en": 2, "fr": 1, "de": 1},
+		LanguagePairs: map[LanguagePair]int{{"en", "fr"}: 1, {"de", "en"}: 1, {"de", "fr"}: 1},
+		ExtractTypes:  map[content.ExtractType]int{"testType": 2, "otherType": 1},
+		FlavorTypes:   map[content.FlavorType]int{"testFlavor": 2, "otherFlavor": 1},
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("Expected facets %+v, got %+v", expected, facets)
+	}
+
+	facets, err = db.Facets(&ExtractFilter{Languages: []language.Code{"en"}, FlavorType: "testFlavor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facets.Total != 2 || facets.ExtractTypes["otherType"] != 0 || facets.Languages["fr"] != 1 {
+		t.Errorf("Unexpected filtered facets %+v", facets)
+	}
+}
+
+func TestRecentChanges(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title"))
+	insertTestExtract(t, db, "b", "slug-b", nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("units", "other", newUnitId(a.ExtractId, a.Language, a.Type, a.Id, 1, 1), &unitUpdate{Content: "new title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	now := time.Now()
+	for _, stmt := range []struct {
+		query string
+		ago   time.Duration
+	}{
+		{"update extracts_history set time=? where extractId='a'", 10 * time.Minute},
+		{"update flavors_history set time=? where extractId='a'", 10 * time.Minute},
+		{"update units_history set time=? where extractId='a' and author='tester'", 10 * time.Minute},
+		{"update units_history set time=? where extractId='a' and author='other'", 5 * time.Minute},
+		{"update extracts_history set time=? where extractId='b'", 2 * time.Hour},
+		{"update flavors_history set time=? where extractId='b'", time.Minute},
+	} {
+		_, err := db.db.Exec(stmt.query, now.Add(-stmt.ago).Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary := func(groups []*ChangeGroup) []string {
+		s := make([]string, len(groups))
+		for i, g := range groups {
+			levels := make([]string, len(g.Changes))
+			for j, c := range g.Changes {
+				levels[j] = string(c.Level)
+			}
+			sort.Strings(levels)
+			s[i] = fmt.Sprintf("%s/%s:%s", g.ExtractId, g.Author, strings.Join(levels, ","))
+		}
+		return s
+	}
+	for _, test := range []struct {
+		since    time.Duration
+		limit    int
+		expected []string
+	}{
+		{3 * time.Hour, 0, []string{"b/tester:flavor", "a/other:unit", "a/tester:extract,flavor,unit", "b/tester:extract"}},
+		{3 * time.Hour, 2, []string{"b/tester:flavor", "a/other:unit"}},
+		{time.Hour, 0, []string{"b/tester:flavor", "a/other:unit", "a/tester:extract,flavor,unit"}},
+	} {
+		groups, err := db.RecentChanges(now.Add(-test.since), test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := summary(groups); !reflect.DeepEqual(s, test.expected) {
+			t.Errorf("Changes since %v (limit %d): expected %v, got %v", test.since, test.limit, test.expected, s)
+		}
+	}
+
+	groups, err := db.RecentChanges(now.Add(-time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := groups[1].Changes[0]
+	if c.Flavor.Language != "en" || c.BlockId != 1 || c.UnitId != 1 || c.Version.Number != 1 || c.Version.EditType != content.EditUpdate {
+		t.Errorf("Unexpected unit change %+v (version %+v)", c, c.Version)
+	}
+}
+
+// TestRecentChangesSameSecond checks that changes made within one second are listed newest first.
+func TestRecentChangesSameSecond(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	defer func(saved func() time.Time) { now = saved }(now)
+	stopped := time.Now()
+	now = func() time.Time { return stopped }
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title"))
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("extracts", testAuthor, newExtractId(a.ExtractId),
+		&extractUpdate{Slug: "slug-a", ExtractType: "other", Metadata: []byte("null")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	updateTestUnit(t, db, a, 1, 1, "v1")
+	updateTestUnit(t, db, a, 1, 1, "v2")
+
+	groups, err := db.RecentChanges(stopped.Add(-time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("Expected one session, got %d", len(groups))
+	}
+	changes := make([]string, 0)
+	for _, c := range groups[0].Changes[:3] {
+		changes = append(changes, fmt.Sprintf("%s%d", c.Level, c.Version.Number))
+	}
+	if expected := []string{"unit2", "unit1", "extract1"}; !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestAuthorContributions(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title", "body"))
+	updateTestUnit(t, db, a, 1, 1, "new title")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersionedFlavor("other", &content.Flavor{ExtractId: a.ExtractId, Language: "fr", Type: a.Type, Id: 1,
+		Blocks: testUnits("titre")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertOrUpdateVersioned("units", "other", newUnitId(a.ExtractId, a.Language, a.Type, a.Id, 2, 1), &unitUpdate{Content: "new body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	changes, err := db.ContributionsByAuthor("other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %d", len(changes))
+	}
+	for _, c := range changes {
+		if c.ExtractId != "a" || c.Version.Author != "other" {
+			t.Errorf("Unexpected change %+v", c)
+		}
+	}
+	changes, err = db.ContributionsByAuthor("other", &Paging{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("Expected 1 change, got %d", len(changes))
+	}
+
+	for name, expected := range map[user.Name]*AuthorStats{
+		testAuthor: {ExtractsCreated: 1, FlavorsAdded: 1, UnitsEdited: 2, Languages: []language.Code{"en"}},
+		"other":    {FlavorsAdded: 1, UnitsEdited: 2, Languages: []language.Code{"en", "fr"}},
+		"nobody":   {Languages: []language.Code{}},
+	} {
+		stats, err := db.AuthorStats(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "nobody" && (stats.FirstActivity.IsZero() || stats.LastActivity.Before(stats.FirstActivity)) {
+			t.Errorf("Author %s: unexpected activity %v - %v", name, stats.FirstActivity, stats.LastActivity)
+		}
+		stats.FirstActivity, stats.LastActivity = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Errorf("Author %s: expected stats %+v, got %+v", name, expected, stats)
+		}
+	}
+
+	// Restoring deleted content does not count as creating it.
+	err = db.DeleteExtract("moderator", a.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RestoreExtract("moderator", a.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, created := range map[user.Name][2]int{testAuthor: {1, 1}, "other": {0, 1}, "moderator": {0, 0}} {
+		stats, err := db.AuthorStats(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ExtractsCreated != created[0] || stats.FlavorsAdded != created[1] {
+			t.Errorf("Author %s: expected %d extracts created and %d flavors added after a restore, got %+v", name, created[0], created[1], stats)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	dir := t.TempDir()
+	old := filepath.Join(dir, "content-20000101-000000.db")
+	for _, f := range []string{old, old + ".sha256"} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insertTestExtract(t, db, "a", "slug-a", testUnits("title"))
+	info, err := db.Backup(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Old backup should have been rotated out: %v", err)
+	}
+	manifest, err := os.ReadFile(info.File + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(manifest), info.Sha256+"  ") {
+		t.Errorf("Unexpected manifest %q for checksum %s", manifest, info.Sha256)
+	}
+	next, err := db.Backup(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.File == info.File {
+		t.Errorf("Backups in quick succession should not share file %s", next.File)
+	}
+	if _, err := os.Stat(info.File); err != nil {
+		t.Errorf("Backup should not be overwritten: %v", err)
+	}
+
+	err = db.DeleteExtract(testAuthor, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestExtract(t, db, "b", "slug-b", nil)
+
+	// Restores wait for writes in progress.
+	locked, unlock := make(chan bool), make(chan bool)
+	go db.withExtractLock_NoCheck(context.Background(), "b", func() error {
+		locked <- true
+		<-unlock
+		return nil
+	})
+	<-locked
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = db.RestoreContext(ctx, info.File)
+	cancel()
+	unlock <- true
+	if err != context.DeadlineExceeded {
+		t.Errorf("Restore should wait for the extract lock, got %v", err)
+	}
+
+	err = db.Restore(info.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := db.ExtractList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "a" {
+		t.Errorf("Expected extract a only after restore, got %v", list)
+	}
+	e, err := db.GetExtract("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Flavors["en"]["testFlavor"][0].Blocks[0][0].Content != "title" {
+		t.Errorf("Unexpected restored extract %+v", e)
+	}
+	if results, err := db.Search("title", "en", 0); err == nil && len(results) != 1 {
+		t.Errorf("Expected restored units to be searchable, got %v", results)
+	}
+
+	err = os.WriteFile(info.File+".sha256", []byte("0000  "+filepath.Base(info.File)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Restore(info.File); err == nil {
+		t.Error("Restore should check the manifest")
+	}
+
+	other := filepath.Join(dir, "other.db")
+	otherDB, err := sql.Open("sqlite3", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = otherDB.Exec("create table extracts (extractId text)")
+	otherDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Restore(other); err == nil || !strings.Contains(err.Error(), "columns") {
+		t.Errorf("Restore should check the schema, got %v", err)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title"))
+	updateTestUnit(t, db, a, 1, 1, "v1")
+	updateTestUnit(t, db, a, 1, 1, "v2")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, "b", "SLUG-A", "story", []byte("null"))
+	tx.Commit()
+	if err == nil {
+		t.Fatal("The unique slug index should reject SLUG-A")
+	}
+	// Indexes prevent most inconsistencies, but older databases lack them.
+	stmts := []string{"drop index extracts_lower_slug"}
+	for _, key := range IndexedMetadata {
+		stmts = append(stmts, "drop index if exists extracts_metadata_"+key)
+	}
+	for _, stmt := range append(stmts,
+		"insert into units values ('a','fr','text',1,1,1,'','orphan')",
+		"insert into flavors values ('zz','en','text',1,'','')",
+		"insert into units values ('zz','en','text',1,1,1,'','orphan flavor')",
+		"update extracts set metadata='{' where extractId='a'",
+		"delete from units_history where extractId='a' and units_version=1",
+	) {
+		if _, err := db.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, "b", "SLUG-A", "story", []byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersioned("extracts", testAuthor, "c", "slug-c", nil, []byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	count := func(problems []*IntegrityProblem, repaired bool) map[ProblemKind]int {
+		kinds := make(map[ProblemKind]int)
+		for _, p := range problems {
+			if p.Repaired != repaired {
+				t.Errorf("Problem %+v: expected repaired %v", p, repaired)
+			}
+			kinds[p.Kind]++
+		}
+		return kinds
+	}
+	expected := map[ProblemKind]int{
+		MissingHistory:     3,
+		OrphanFlavor:       1,
+		OrphanUnit:         1,
+		VersionGap:         1,
+		DuplicateSlug:      1,
+		InvalidExtractType: 2,
+		InvalidFlavorType:  1,
+		InvalidMetadata:    1,
+	}
+	problems, err := db.CheckIntegrity(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := count(problems, false); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected problems %v, got %v", expected, kinds)
+	}
+	// Checking twice finds the same problems, and reports do not wait for writers.
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = db.CheckIntegrity(false)
+	tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds := count(problems, false); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected problems %v, got %v", expected, kinds)
+	}
+
+	problems, err = db.CheckIntegrity(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired := 0
+	for _, p := range problems {
+		if p.Repaired {
+			repaired++
+		}
+	}
+	if len(problems) != 11 || repaired != 6 {
+		t.Errorf("Expected 6 repaired problems out of 11, got %d out of %d", repaired, len(problems))
+	}
+
+	problems, err = db.CheckIntegrity(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[ProblemKind]int{
+		VersionGap:         1,
+		InvalidExtractType: 2,
+		InvalidFlavorType:  1,
+		InvalidMetadata:    1,
+	}
+	if kinds := count(problems, false); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected remaining problems %v, got %v", expected, kinds)
+	}
+
+	changes, err := db.ContributionsByAuthor(SystemAuthor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Error("Repairs should be recorded as edits by the system author")
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	a := insertTestExtract(t, db, "a", "slug-a", testUnits("title", "body"))
+	insertTestExtract(t, db, "b", "slug-b", nil)
+	updateTestUnit(t, db, a, 1, 1, "new title")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertVersionedFlavor(testAuthor, &content.Flavor{ExtractId: a.ExtractId, Language: "fr", Type: "otherFlavor", Id: 1,
+		Blocks: testUnits("titre")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Counts != (Counts{Extracts: 2, Flavors: 3, Units: 3}) {
+		t.Errorf("Unexpected counts %+v", stats.Counts)
+	}
+	for _, test := range []struct {
+		got, expected *Counts
+	}{
+		{stats.ByLanguage["en"], &Counts{Extracts: 2, Flavors: 2, Units: 2}},
+		{stats.ByLanguage["fr"], &Counts{Extracts: 1, Flavors: 1, Units: 1}},
+		{stats.ByFlavorType["testFlavor"], &Counts{Extracts: 2, Flavors: 2, Units: 2}},
+		{stats.ByFlavorType["otherFlavor"], &Counts{Extracts: 1, Flavors: 1, Units: 1}},
+	} {
+		if test.got == nil || *test.got != *test.expected {
+			t.Errorf("Expected counts %+v, got %+v", test.expected, test.got)
+		}
+	}
+	expected := map[string]int{"extracts": 2, "flavors": 3, "units": 4, "slug_aliases": 0}
+	if !reflect.DeepEqual(stats.HistoryRows, expected) {
+		t.Errorf("Expected history rows %v, got %v", expected, stats.HistoryRows)
+	}
+	if stats.FileSize == 0 || stats.PageSize == 0 || stats.PageCount == 0 {
+		t.Errorf("Unexpected file statistics %+v", stats)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	db := openTestDB(t)
+	defer func() { closeTestDB(db) }()
+
+	for i, m := range migrations {
+		if m.Id != i+1 {
+			t.Fatalf("Migration %q should have id %d, not %d", m.Name, i+1, m.Id)
+		}
+	}
+	statuses, err := db.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(migrations) {
+		t.Fatalf("Expected %d migrations, got %d", len(migrations), len(statuses))
+	}
+	for _, s := range statuses {
+		if s.Applied.IsZero() {
+			t.Errorf("Migration %d should have been applied when opening the database", s.Id)
+		}
+	}
+
+	saved := migrations
+	defer func() { migrations = saved }()
+	next := len(migrations) + 1
+	migrations = append(migrations[:len(migrations):len(migrations)], &migration{
+		Id:   next,
+		Name: "test",
+		Up: func(tx *sql.Tx) error {
+			for _, table := range []string{"extracts", "extracts_history"} {
+				_, err := tx.Exec("alter table " + table + " add column tags text")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, &migration{
+		Id:   next + 1,
+		Name: "failing",
+		Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("alter table missing add column tags text")
+			return err
+		},
+	})
+	hasTags := func() bool {
+		var n int
+		err := db.db.QueryRow("select count(1) from pragma_table_info('extracts') where name='tags'").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n != 0
+	}
+
+	statuses, err = PendingMigrations(testDB, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != next+1 || !statuses[next-1].Applied.IsZero() || !statuses[next].Applied.IsZero() {
+		t.Errorf("Expected 2 pending migrations, got %+v", statuses)
+	}
+	statuses, err = PendingMigrations(testDB, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[next-1].Error != "" || statuses[next].Error == "" {
+		t.Errorf("Expected the last migration to fail, got %+v and %+v", statuses[next-1], statuses[next])
+	}
+	if hasTags() {
+		t.Error("A dry run should not change the database")
+	}
+
+	db.Close()
+	_, err = Open(testDB)
+	if err == nil {
+		t.Fatal("Open should fail with a failing migration")
+	}
+	migrations = migrations[:next]
+	db, err = Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasTags() {
+		t.Error("Pending migrations should be applied when opening the database")
+	}
+
+	// Writes and reads should be unaffected by the added column.
+	f := insertTestExtract(t, db, "extract1", "slug1", testUnits("title"))
+	e, err := db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.UrlSlug != "slug1" || len(e.Flavors[f.Language][f.Type]) != 1 {
+		t.Errorf("Unexpected extract after migration: %+v", e)
+	}
+	_, err = db.db.Exec("update extracts set tags='tagged' where extractId=?", string(f.ExtractId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RestoreExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetExtract(f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.db.Exec("update extracts set tags='tagged' where extractId=?", string(f.ExtractId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.Backup(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteExtract(testAuthor, f.ExtractId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Restore(info.File)
+	if err != nil {
+		t.Fatalf("Backups of the migrated database should be restored: %v", err)
+	}
+	var tags string
+	err = db.db.QueryRow("select tags from extracts where extractId=?", string(f.ExtractId)).Scan(&tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags != "tagged" {
+		t.Errorf("Restore should keep migrated columns, got %q", tags)
+	}
+
+	migrations = saved
+	db.Close()
+	_, err = Open(testDB)
+	if err == nil || !strings.Contains(err.Error(), "newer server") {
+		t.Errorf("Opening a database migrated by a newer server should fail, got %v", err)
+	}
+	db, err = Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,18 +2,23 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/polyglottis/platform/content"
 	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
 )
 
 func (db *DB) ExtractList() ([]*content.Extract, error) {
-	rows, err := db.db.Query("select extractId, extractType, slug from extracts")
-	if err != nil {
-		return nil, err
-	}
-	return scanExtractList(rows)
+	return db.ExtractListContext(context.Background())
+}
+
+func (db *DB) ExtractListContext(ctx context.Context) ([]*content.Extract, error) {
+	return db.FilteredExtractListContext(ctx, nil)
 }
 
 func (db *DB) ExtractLanguages() ([]language.Code, error) {
@@ -57,22 +62,237 @@ func scanExtractList(rows *sql.Rows) ([]*content.Extract, error) {
 }
 
 func (db *DB) ExtractListWithLanguage(lang language.Code) ([]*content.Extract, error) {
-	rows, err := db.db.Query(
-		"select distinct(e.extractId), e.extractType,e.slug from extracts e, flavors f where "+
-			"e.extractId=f.extractId and f.language=?", string(lang))
+	return db.ExtractListWithLanguageContext(context.Background(), lang)
+}
+
+func (db *DB) ExtractListWithLanguageContext(ctx context.Context, lang language.Code) ([]*content.Extract, error) {
+	return db.FilteredExtractListContext(ctx, &ExtractFilter{Languages: []language.Code{lang}})
+}
+
+func (db *DB) ExtractListWithLanguages(langA, langB language.Code) ([]*content.Extract, error) {
+	return db.ExtractListWithLanguagesContext(context.Background(), langA, langB)
+}
+
+func (db *DB) ExtractListWithLanguagesContext(ctx context.Context, langA, langB language.Code) ([]*content.Extract, error) {
+	return db.FilteredExtractListContext(ctx, &ExtractFilter{Languages: []language.Code{langA, langB}})
+}
+
+// ExtractFilter selects extracts. Zero fields are ignored, so the zero filter selects all extracts.
+type ExtractFilter struct {
+	ExtractType content.ExtractType
+	// Languages are all required.
+	Languages []language.Code
+	// FlavorType is required in each of the languages, or in any language if there are none.
+	FlavorType content.FlavorType
+	// Author must have edited the extract, one of its flavors or one of its units.
+	Author user.Name
+	// ModifiedSince and ModifiedBefore bound the time of the last edit of the extract.
+	ModifiedSince  time.Time
+	ModifiedBefore time.Time
+	// Metadata conditions are all required.
+	Metadata []MetadataCondition
+}
+
+// QueryFilter returns the filter matching q.
+func QueryFilter(q *content.Query) *ExtractFilter {
+	f := &ExtractFilter{ExtractType: q.ExtractType}
+	for _, lang := range []language.Code{q.LanguageA, q.LanguageB} {
+		if len(lang) != 0 {
+			f.Languages = append(f.Languages, lang)
+		}
+	}
+	return f
+}
+
+// where returns the condition on extracts e matching f, with its arguments.
+// It returns content.ErrInvalidInput if a metadata condition is invalid,
+// and ErrMetadataUnavailable if there are metadata conditions but sqlite cannot evaluate them (filterable is false).
+func (f *ExtractFilter) where(filterable bool) (string, []interface{}, error) {
+	if f == nil {
+		return "1", nil, nil
+	}
+	conds := []string{"1"}
+	args := make([]interface{}, 0)
+	if len(f.ExtractType) != 0 {
+		conds = append(conds, "e.extractType=?")
+		args = append(args, string(f.ExtractType))
+	}
+	flavorType := ""
+	if len(f.FlavorType) != 0 {
+		flavorType = " and f.flavorType=?"
+	}
+	byLanguage := false
+	for _, lang := range f.Languages {
+		if len(lang) == 0 {
+			continue
+		}
+		byLanguage = true
+		conds = append(conds, "exists (select 1 from flavors f where f.extractId=e.extractId and f.language=?"+flavorType+")")
+		args = append(args, string(lang))
+		if len(flavorType) != 0 {
+			args = append(args, string(f.FlavorType))
+		}
+	}
+	if !byLanguage && len(flavorType) != 0 {
+		conds = append(conds, "exists (select 1 from flavors f where f.extractId=e.extractId"+flavorType+")")
+		args = append(args, string(f.FlavorType))
+	}
+	if len(f.Author) != 0 {
+		authored := make([]string, 0, 3)
+		for _, t := range []string{"extracts", "flavors", "units"} {
+			authored = append(authored, fmt.Sprintf("exists (select 1 from %s h where h.extractId=e.extractId and h.author=?)", history(t)))
+			args = append(args, string(f.Author))
+		}
+		conds = append(conds, "("+strings.Join(authored, " or ")+")")
+	}
+	if !f.ModifiedSince.IsZero() {
+		conds = append(conds, sortSql[SortByModified]+">=?")
+		args = append(args, f.ModifiedSince.Unix())
+	}
+	if !f.ModifiedBefore.IsZero() {
+		conds = append(conds, sortSql[SortByModified]+"<?")
+		args = append(args, f.ModifiedBefore.Unix())
+	}
+	for _, c := range f.Metadata {
+		cond, err := c.sql()
+		if err != nil {
+			return "", nil, err
+		}
+		if !filterable {
+			return "", nil, ErrMetadataUnavailable
+		}
+		conds = append(conds, cond)
+		args = append(args, c.Value)
+	}
+	return strings.Join(conds, " and "), args, nil
+}
+
+// Sql returns the query listing the id, type and slug of the extracts matching f, with its arguments.
+// Metadata conditions need sqlite built with JSON1.
+func (f *ExtractFilter) Sql() (string, []interface{}, error) {
+	return f.sql(true)
+}
+
+func (f *ExtractFilter) sql(filterable bool) (string, []interface{}, error) {
+	where, args, err := f.where(filterable)
+	if err != nil {
+		return "", nil, err
+	}
+	return "select e.extractId, e.extractType, e.slug from extracts e where " + where, args, nil
+}
+
+// FilteredExtractList lists the extracts matching f.
+func (db *DB) FilteredExtractList(f *ExtractFilter) ([]*content.Extract, error) {
+	return db.FilteredExtractListContext(context.Background(), f)
+}
+
+func (db *DB) FilteredExtractListContext(ctx context.Context, f *ExtractFilter) ([]*content.Extract, error) {
+	query, args, err := f.sql(db.filterable)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	return scanExtractList(rows)
 }
 
-func (db *DB) ExtractListWithLanguages(langA, langB language.Code) ([]*content.Extract, error) {
-	rows, err := db.db.Query(
-		"select distinct(e.extractId), e.extractType,e.slug from extracts e, flavors f1, flavors f2 where "+
-			"e.extractId=f1.extractId and e.extractId=f2.extractId and f1.language=? and f2.language=?;",
-		string(langA), string(langB))
+// SortKey is a sort order of extract lists.
+type SortKey string
+
+const (
+	SortBySlug      SortKey = "slug"
+	SortByCreated   SortKey = "created"
+	SortByModified  SortKey = "modified"
+	SortByLanguages SortKey = "languages" // number of languages
+)
+
+var sortSql = map[SortKey]string{
+	SortBySlug:    "lower(e.slug)",
+	SortByCreated: "(select min(time) from extracts_history h where h.extractId=e.extractId)",
+	SortByModified: "max((select max(time) from extracts_history h where h.extractId=e.extractId), " +
+		"coalesce((select max(time) from flavors_history h where h.extractId=e.extractId), 0), " +
+		"coalesce((select max(time) from units_history h where h.extractId=e.extractId), 0))",
+	SortByLanguages: "(select count(distinct(language)) from flavors f where f.extractId=e.extractId)",
+}
+
+// ListOptions defines the order and the window of extract lists.
+// The zero value lists all extracts by slug.
+type ListOptions struct {
+	Sort       SortKey
+	Descending bool
+	Paging
+}
+
+// ExtractPage is a window of an extract list.
+type ExtractPage struct {
+	Ids []content.ExtractId
+	// Total is the number of extracts in the whole list.
+	Total int
+}
+
+// ExtractsPage lists the extracts matching q, in the order and window given by opts.
+// Extracts comparing equal are sorted by id, so that the order is stable.
+func (db *DB) ExtractsPage(q *content.Query, opts *ListOptions) (*ExtractPage, error) {
+	return db.ExtractsPageContext(context.Background(), q, opts)
+}
+
+func (db *DB) ExtractsPageContext(ctx context.Context, q *content.Query, opts *ListOptions) (*ExtractPage, error) {
+	return db.FilteredExtractsPageContext(ctx, QueryFilter(q), opts)
+}
+
+// FilteredExtractsPage lists the extracts matching f, in the order and window given by opts.
+func (db *DB) FilteredExtractsPage(f *ExtractFilter, opts *ListOptions) (*ExtractPage, error) {
+	return db.FilteredExtractsPageContext(context.Background(), f, opts)
+}
+
+func (db *DB) FilteredExtractsPageContext(ctx context.Context, f *ExtractFilter, opts *ListOptions) (*ExtractPage, error) {
+	if opts == nil {
+		opts = new(ListOptions)
+	}
+	sortBy := opts.Sort
+	if len(sortBy) == 0 {
+		sortBy = SortBySlug
+	}
+	order, ok := sortSql[sortBy]
+	if !ok {
+		return nil, content.ErrInvalidInput
+	}
+	if opts.Descending {
+		order += " desc"
+	}
+
+	where, args, err := f.where(db.filterable)
 	if err != nil {
 		return nil, err
 	}
-	return scanExtractList(rows)
+	from := "from extracts e where " + where
+
+	page := &ExtractPage{
+		Ids: make([]content.ExtractId, 0),
+	}
+	err = db.db.QueryRowContext(ctx, "select count(1) "+from, args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, fmt.Sprintf("select e.extractId %s order by %s, e.extractId", from, order)+opts.Paging.Sql(),
+		append(args, opts.Paging.Values()...)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		page.Ids = append(page.Ids, content.ExtractId(id))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return page, nil
 }
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// DeleteExtract deletes an extract, together with all its flavors and units.
+func (db *DB) DeleteExtract(author user.Name, id content.ExtractId) error {
+	return db.DeleteExtractContext(context.Background(), author, id)
+}
+
+func (db *DB) DeleteExtractContext(ctx context.Context, author user.Name, id content.ExtractId) error {
+	return db.withExtractLock(ctx, id, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		extractId := newExtractId(id)
+		err = tx.deleteVersionedAll(unitsTable, author, extractId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.deleteVersionedAll(flavorsTable, author, extractId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.DeleteVersioned("extracts", author, extractId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// DeleteFlavor deletes a flavor, together with all its units.
+func (db *DB) DeleteFlavor(author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) error {
+	return db.DeleteFlavorContext(context.Background(), author, extractId, lang, flavorType, flavorId)
+}
+
+func (db *DB) DeleteFlavorContext(ctx context.Context, author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) error {
+	return db.withFlavorLock(ctx, extractId, lang, flavorType, flavorId, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		id := newFlavorId(extractId, lang, flavorType, flavorId)
+		err = tx.deleteVersionedAll(unitsTable, author, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.DeleteVersioned("flavors", author, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// DeleteUnits deletes the given units, which must all belong to the same flavor.
+// Only the ids of the units are taken into account.
+func (db *DB) DeleteUnits(author user.Name, units []*content.Unit) error {
+	return db.DeleteUnitsContext(context.Background(), author, units)
+}
+
+func (db *DB) DeleteUnitsContext(ctx context.Context, author user.Name, units []*content.Unit) error {
+	if len(units) == 0 {
+		return nil
+	}
+
+	extractId := units[0].ExtractId
+	lang := units[0].Language
+	flavorType := units[0].FlavorType
+	flavorId := units[0].FlavorId
+	for _, u := range units {
+		if u.ExtractId != extractId || u.Language != lang || u.FlavorType != flavorType || u.FlavorId != flavorId ||
+			u.BlockId <= 0 || u.Id <= 0 {
+			return content.ErrInvalidInput
+		}
+	}
+
+	return db.withFlavorLock(ctx, extractId, lang, flavorType, flavorId, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range units {
+			err := tx.DeleteVersioned("units", author, newUnitId(extractId, lang, flavorType, flavorId, u.BlockId, u.Id))
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// RestoreExtract restores a deleted extract, together with the flavors and units deleted with it.
+// It fails with a *SlugTakenError if the slug of the extract has since been taken by another extract.
+func (db *DB) RestoreExtract(author user.Name, id content.ExtractId) error {
+	return db.RestoreExtractContext(context.Background(), author, id)
+}
+
+func (db *DB) RestoreExtractContext(ctx context.Context, author user.Name, id content.ExtractId) error {
+	return db.withExtractLock_NoCheck(ctx, id, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		extractId := newExtractId(id)
+		deleted, err := tx.deletionSeq("extracts", extractId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		e := new(extractUpdate)
+		err = tx.RestoreVersioned("extracts", author, extractId, e)
+		if err != nil {
+			tx.Rollback()
+			return slugError(err, e.Slug)
+		}
+
+		err = tx.checkSlug(e.Slug, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.restoreVersionedAll(flavorsTable, author, extractId, deleted, func() interface{} { return new(flavorUpdate) })
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.restoreVersionedAll(unitsTable, author, extractId, deleted, func() interface{} { return new(unitUpdate) })
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// RestoreFlavor restores a deleted flavor, together with the units deleted with it.
+// The extract of the flavor must exist.
+func (db *DB) RestoreFlavor(author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) error {
+	return db.RestoreFlavorContext(context.Background(), author, extractId, lang, flavorType, flavorId)
+}
+
+func (db *DB) RestoreFlavorContext(ctx context.Context, author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) error {
+	return db.withExtractLock(ctx, extractId, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		id := newFlavorId(extractId, lang, flavorType, flavorId)
+		deleted, err := tx.deletionSeq("flavors", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.RestoreVersioned("flavors", author, id, new(flavorUpdate))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.restoreVersionedAll(unitsTable, author, id, deleted, func() interface{} { return new(unitUpdate) })
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// deletionSeq returns the sequence number of the transaction which deleted a row.
+// The latest version of the row must be a deletion.
+func (tx *Tx) deletionSeq(table string, id rowKey) (int64, error) {
+	v, err := tx.LatestVersion(table, id)
+	switch {
+	case err != nil:
+		return 0, err
+	case v.Number == -1:
+		return 0, content.ErrNotFound
+	case v.EditType != content.EditDelete:
+		return 0, content.ErrInvalidInput
+	}
+	var seq int64
+	err = tx.QueryRow(fmt.Sprintf("select seq from %s where %s and %s=?", history(table), id.Sql(), version(table)),
+		append(id.Values(), v.Number)...).Scan(&seq)
+	return seq, err
+}
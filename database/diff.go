@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// FlavorDiff lists the unit changes between two versions of a flavor, block by block.
+// Only blocks containing changes are listed, sorted by block id.
+type FlavorDiff struct {
+	Blocks []*BlockDiff
+}
+
+type BlockDiff struct {
+	BlockId content.BlockId
+	Added   []*content.Unit
+	Removed []*content.Unit
+	Changed []*UnitDiff
+}
+
+type UnitDiff struct {
+	From  *content.Unit
+	To    *content.Unit
+	Words []*WordDiff
+}
+
+type WordOp int
+
+const (
+	WordEqual WordOp = iota
+	WordAdded
+	WordRemoved
+)
+
+// WordDiff is a run of consecutive words (separated by single spaces) sharing the same operation.
+type WordDiff struct {
+	Op   WordOp
+	Text string
+}
+
+// FlavorRevisions lists the revisions of a flavor, oldest first.
+// A revision is an edit of the flavor or of its units; the Number of a revision is its position in the list.
+// The edit type of a revision is the type of the flavor edit if there is one, or of one of its unit edits.
+func (db *DB) FlavorRevisions(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType,
+	flavorId content.FlavorId) ([]*content.Version, error) {
+	id := newFlavorId(extractId, lang, flavorType, flavorId)
+	rows, err := db.db.Query("select author, time, editType, min(level) from ("+
+		"select author, time, seq, editType, 0 level from flavors_history where "+id.Sql()+
+		" union all select author, time, seq, editType, 1 from units_history where "+id.Sql()+
+		") group by seq order by seq", append(id.Values(), id.Values()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]*content.Version, 0)
+	for rows.Next() {
+		var author, editType string
+		var date int64
+		var level int
+		err := rows.Scan(&author, &date, &editType, &level)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &content.Version{
+			Author:   user.Name(author),
+			Time:     time.Unix(date, 0),
+			Number:   len(revisions),
+			EditType: content.EditType(editType),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// DiffFlavor compares the units of a flavor as they were at revisions fromRevision and toRevision of the flavor,
+// as numbered by FlavorRevisions. A negative revision number designates the current state of the flavor.
+func (db *DB) DiffFlavor(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId,
+	fromRevision, toRevision int) (*FlavorDiff, error) {
+	from, err := db.flavorBlocksAt(extractId, lang, flavorType, flavorId, fromRevision)
+	if err != nil {
+		return nil, err
+	}
+	to, err := db.flavorBlocksAt(extractId, lang, flavorType, flavorId, toRevision)
+	if err != nil {
+		return nil, err
+	}
+	return diffBlocks(from, to), nil
+}
+
+func (db *DB) flavorBlocksAt(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId,
+	number int) (content.BlockSlice, error) {
+	var e *content.Extract
+	var err error
+	if number < 0 {
+		e, err = db.GetExtract(extractId)
+	} else {
+		id := newFlavorId(extractId, lang, flavorType, flavorId)
+		var seq int64
+		err = db.db.QueryRow("select seq from (select seq from flavors_history where "+id.Sql()+
+			" union select seq from units_history where "+id.Sql()+") order by seq limit 1 offset ?",
+			append(append(id.Values(), id.Values()...), number)...).Scan(&seq)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, content.ErrNotFound
+		case err != nil:
+			return nil, err
+		}
+		e, err = db.getExtractAtSeq(context.Background(), extractId, seq)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range e.Flavors[lang][flavorType] {
+		if f.Id == flavorId {
+			return f.Blocks, nil
+		}
+	}
+	return nil, nil
+}
+
+type unitPosition struct {
+	BlockId content.BlockId
+	UnitId  content.UnitId
+}
+
+func diffBlocks(from, to content.BlockSlice) *FlavorDiff {
+	unitMap := func(blocks content.BlockSlice) map[unitPosition]*content.Unit {
+		m := make(map[unitPosition]*content.Unit)
+		for _, block := range blocks {
+			for _, u := range block {
+				m[unitPosition{u.BlockId, u.Id}] = u
+			}
+		}
+		return m
+	}
+	fromUnits := unitMap(from)
+	toUnits := unitMap(to)
+
+	keys := make([]unitPosition, 0, len(fromUnits)+len(toUnits))
+	for k := range fromUnits {
+		keys = append(keys, k)
+	}
+	for k := range toUnits {
+		if _, ok := fromUnits[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].BlockId != keys[j].BlockId {
+			return keys[i].BlockId < keys[j].BlockId
+		}
+		return keys[i].UnitId < keys[j].UnitId
+	})
+
+	diff := &FlavorDiff{Blocks: make([]*BlockDiff, 0)}
+	var block *BlockDiff
+	blockDiff := func(id content.BlockId) *BlockDiff {
+		if block == nil || block.BlockId != id {
+			block = &BlockDiff{BlockId: id}
+			diff.Blocks = append(diff.Blocks, block)
+		}
+		return block
+	}
+	for _, k := range keys {
+		f, inFrom := fromUnits[k]
+		t, inTo := toUnits[k]
+		switch {
+		case !inFrom:
+			b := blockDiff(k.BlockId)
+			b.Added = append(b.Added, t)
+		case !inTo:
+			b := blockDiff(k.BlockId)
+			b.Removed = append(b.Removed, f)
+		case f.Content != t.Content || f.ContentType != t.ContentType:
+			b := blockDiff(k.BlockId)
+			b.Changed = append(b.Changed, &UnitDiff{
+				From:  f,
+				To:    t,
+				Words: diffWords(f.Content, t.Content),
+			})
+		}
+	}
+	return diff
+}
+
+// diffWords computes a word-level diff of two texts, using the longest common subsequence of words.
+func diffWords(from, to string) []*WordDiff {
+	a := strings.Fields(from)
+	b := strings.Fields(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]*WordDiff, 0)
+	add := func(op WordOp, word string) {
+		if n := len(diff); n > 0 && diff[n-1].Op == op {
+			diff[n-1].Text += " " + word
+		} else {
+			diff = append(diff, &WordDiff{Op: op, Text: word})
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			add(WordEqual, a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add(WordRemoved, a[i])
+			i++
+		default:
+			add(WordAdded, b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(WordRemoved, a[i])
+	}
+	for ; j < len(b); j++ {
+		add(WordAdded, b[j])
+	}
+	return diff
+}
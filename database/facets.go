@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+)
+
+// LanguagePair is an unordered pair of languages, with A < B.
+type LanguagePair struct {
+	A, B language.Code
+}
+
+// Facets counts the extracts matching a filter, per property.
+// An extract with several languages (or flavor types) counts once for each of them.
+type Facets struct {
+	Total         int
+	Languages     map[language.Code]int
+	LanguagePairs map[LanguagePair]int
+	ExtractTypes  map[content.ExtractType]int
+	FlavorTypes   map[content.FlavorType]int
+}
+
+// Facets counts the extracts matching f, per language, language pair, extract type and flavor type.
+func (db *DB) Facets(f *ExtractFilter) (*Facets, error) {
+	return db.FacetsContext(context.Background(), f)
+}
+
+func (db *DB) FacetsContext(ctx context.Context, f *ExtractFilter) (*Facets, error) {
+	where, args, err := f.where(db.filterable)
+	if err != nil {
+		return nil, err
+	}
+	matching := "with matching as (select e.extractId, e.extractType from extracts e where " + where + ") "
+
+	facets := &Facets{
+		Languages:     make(map[language.Code]int),
+		LanguagePairs: make(map[LanguagePair]int),
+		ExtractTypes:  make(map[content.ExtractType]int),
+		FlavorTypes:   make(map[content.FlavorType]int),
+	}
+	err = db.db.QueryRowContext(ctx, matching+"select count(1) from matching", args...).Scan(&facets.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.countFacet(ctx, matching+"select extractType, count(1) from matching group by extractType", args,
+		func(value string, n int) { facets.ExtractTypes[content.ExtractType(value)] = n })
+	if err != nil {
+		return nil, err
+	}
+	err = db.countFacet(ctx, matching+"select f.language, count(distinct f.extractId) from flavors f "+
+		"join matching m on m.extractId=f.extractId group by f.language", args,
+		func(value string, n int) { facets.Languages[language.Code(value)] = n })
+	if err != nil {
+		return nil, err
+	}
+	err = db.countFacet(ctx, matching+"select f.flavorType, count(distinct f.extractId) from flavors f "+
+		"join matching m on m.extractId=f.extractId group by f.flavorType", args,
+		func(value string, n int) { facets.FlavorTypes[content.FlavorType(value)] = n })
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, matching+", languages as (select distinct f.extractId, f.language from flavors f "+
+		"join matching m on m.extractId=f.extractId) "+
+		"select l1.language, l2.language, count(1) from languages l1 "+
+		"join languages l2 on l1.extractId=l2.extractId and l1.language<l2.language "+
+		"group by l1.language, l2.language", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var a, b string
+		var n int
+		err := rows.Scan(&a, &b, &n)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		facets.LanguagePairs[LanguagePair{A: language.Code(a), B: language.Code(b)}] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
+
+// countFacet runs a query listing values and their counts, and calls set for each of them.
+func (db *DB) countFacet(ctx context.Context, query string, args []interface{}, set func(value string, n int)) error {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var value sql.NullString
+		var n int
+		err := rows.Scan(&value, &n)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		set(value.String, n)
+	}
+	return rows.Err()
+}
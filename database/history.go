@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+)
+
+// ExtractHistory lists all versions of an extract, newest first.
+func (db *DB) ExtractHistory(id content.ExtractId, p *Paging) ([]*content.Version, error) {
+	return db.history("extracts", newExtractId(id), p)
+}
+
+// FlavorHistory lists all versions of a flavor, newest first.
+func (db *DB) FlavorHistory(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId,
+	p *Paging) ([]*content.Version, error) {
+	return db.history("flavors", newFlavorId(extractId, lang, flavorType, flavorId), p)
+}
+
+// UnitHistory lists all versions of a unit, newest first.
+func (db *DB) UnitHistory(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId,
+	blockId content.BlockId, unitId content.UnitId, p *Paging) ([]*content.Version, error) {
+	return db.history("units", newUnitId(extractId, lang, flavorType, flavorId, blockId, unitId), p)
+}
+
+func (db *DB) history(table string, id rowKey, p *Paging) ([]*content.Version, error) {
+	rows, err := db.db.Query(fmt.Sprintf("select author, time, %s, editType from %s where %s order by %s desc",
+		version(table), history(table), id.Sql(), version(table))+p.Sql(), append(id.Values(), p.Values()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make([]*content.Version, 0)
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetExtractAt rebuilds an extract as it was at the given time.
+// Times have a resolution of one second: the extract includes all edits made during the second of t.
+func (db *DB) GetExtractAt(id content.ExtractId, t time.Time) (*content.Extract, error) {
+	return db.getExtract(context.Background(), id, historicQuery(extractsTable, "time"), historicQuery(flavorsTable, "time"),
+		historicQuery(unitsTable, "time"), string(id), t.Unix())
+}
+
+// GetExtractAtVersion rebuilds an extract as it was when the given version of the extract was recorded.
+// Edits are ordered by the sequence numbers of their transactions, so later edits made in the same second are excluded.
+func (db *DB) GetExtractAtVersion(id content.ExtractId, number int) (*content.Extract, error) {
+	var seq int64
+	err := db.db.QueryRow("select seq from extracts_history where extractId=? and extracts_version=?",
+		string(id), number).Scan(&seq)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, content.ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	return db.getExtractAtSeq(context.Background(), id, seq)
+}
+
+// getExtractAtSeq rebuilds an extract as it was after the transaction of the given sequence number.
+func (db *DB) getExtractAtSeq(ctx context.Context, id content.ExtractId, seq int64) (*content.Extract, error) {
+	return db.getExtract(ctx, id, historicQuery(extractsTable, "seq"), historicQuery(flavorsTable, "seq"),
+		historicQuery(unitsTable, "seq"), string(id), seq)
+}
@@ -0,0 +1,302 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/database"
+)
+
+// ProblemKind is a kind of inconsistency of the database.
+type ProblemKind string
+
+const (
+	// OrphanUnit is a unit whose flavor does not exist.
+	OrphanUnit ProblemKind = "orphan unit"
+	// OrphanFlavor is a flavor whose extract does not exist.
+	OrphanFlavor ProblemKind = "orphan flavor"
+	// MissingHistory is a live row without history, or whose last history entry is a deletion.
+	MissingHistory ProblemKind = "missing history"
+	// VersionGap is a row whose history versions are not numbered consecutively from 0.
+	VersionGap ProblemKind = "version gap"
+	// DuplicateSlug is a slug used by several extracts, ignoring case, or formerly used by another extract.
+	DuplicateSlug      ProblemKind = "duplicate slug"
+	InvalidExtractType ProblemKind = "invalid extract type"
+	InvalidFlavorType  ProblemKind = "invalid flavor type"
+	InvalidMetadata    ProblemKind = "invalid metadata"
+)
+
+// IntegrityProblem is an inconsistency found by CheckIntegrity.
+type IntegrityProblem struct {
+	Kind  ProblemKind
+	Table string
+	// Key is the primary key of the row, with fields separated by slashes.
+	Key    string
+	Detail string
+	// Repaired is true if the problem was fixed.
+	Repaired bool
+}
+
+// tableKey is the primary key of a row of a table.
+type tableKey struct {
+	table  *database.Table
+	values []interface{}
+}
+
+func (k *tableKey) Sql() string {
+	return strings.Join(k.table.PrimaryKey, "=? and ") + "=?"
+}
+
+func (k *tableKey) Values() []interface{} {
+	return k.values
+}
+
+func (k *tableKey) String() string {
+	s := make([]string, len(k.values))
+	for i, v := range k.values {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, "/")
+}
+
+// prefix returns the key as a prefix of the rows of the content tables.
+func (k *tableKey) prefix() *primaryKey {
+	pk := new(primaryKey)
+	for i, f := range pk.fields()[:len(k.values)] {
+		switch f := f.(type) {
+		case *string:
+			*f = k.values[i].(string)
+		case *int:
+			*f = int(k.values[i].(int64))
+		}
+	}
+	return pk
+}
+
+// querier runs the queries of integrity checks: a transaction when repairing, the database otherwise.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryKeys lists the keys of the rows of table selected by query, which should select the primary key columns first.
+// If more is not nil, it is called for each row and returns the destinations of the additional columns.
+func queryKeys(q querier, table *database.Table, query string, more func() []interface{}) ([]*tableKey, error) {
+	rows, err := q.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*tableKey, 0)
+	for rows.Next() {
+		k := &tableKey{table: table, values: make([]interface{}, len(table.PrimaryKey))}
+		dest := make([]interface{}, len(k.values))
+		for i := range k.values {
+			dest[i] = &k.values[i]
+		}
+		if more != nil {
+			dest = append(dest, more()...)
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range k.values {
+			if b, ok := v.([]byte); ok {
+				k.values[i] = string(b)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// CheckIntegrity scans the whole database for inconsistencies.
+// If repair is true, the problems which can be fixed safely are fixed, with versioned edits by SystemAuthor:
+// missing history entries are recorded, orphan flavors and units are deleted, and slug collisions are resolved.
+// Version gaps, invalid types and metadata are only reported.
+// Reports without repairs read the database outside of transactions, so that writes are not blocked during the scan.
+func (db *DB) CheckIntegrity(repair bool) ([]*IntegrityProblem, error) {
+	var problems []*IntegrityProblem
+	if repair {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		problems, err = checkIntegrity(tx, tx)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		problems, err = checkIntegrity(db.db, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	collisions, err := db.SlugCollisions()
+	if err != nil {
+		return nil, err
+	}
+	if repair && len(collisions) != 0 {
+		collisions, err = db.FixSlugCollisions()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range collisions {
+		detail := fmt.Sprintf("used by %v", c.ExtractIds)
+		if len(c.AliasOf) != 0 {
+			detail += fmt.Sprintf(", formerly by %v", c.AliasOf)
+		}
+		if len(c.Renamed) != 0 {
+			detail += fmt.Sprintf(", renamed %v", c.Renamed)
+		}
+		problems = append(problems, &IntegrityProblem{Kind: DuplicateSlug, Table: "extracts", Key: c.Slug, Detail: detail, Repaired: repair})
+	}
+	return problems, nil
+}
+
+// checkIntegrity runs the checks of CheckIntegrity with q. If tx is not nil, problems are repaired within tx, which should be q.
+func checkIntegrity(q querier, tx *Tx) ([]*IntegrityProblem, error) {
+	problems := make([]*IntegrityProblem, 0)
+	repair := tx != nil
+
+	for _, table := range []*database.Table{extractsTable, flavorsTable, unitsTable, slugAliasesTable} {
+		found, err := checkHistory(q, table, tx)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+
+	flavors, err := queryKeys(q, flavorsTable, "select extractId, language, flavorType, flavorId from flavors f "+
+		"where not exists (select 1 from extracts e where e.extractId=f.extractId)", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range flavors {
+		if repair {
+			err = tx.deleteVersionedAll(unitsTable, SystemAuthor, k.prefix())
+			if err != nil {
+				return nil, err
+			}
+			err = tx.DeleteVersioned("flavors", SystemAuthor, k)
+			if err != nil {
+				return nil, err
+			}
+		}
+		problems = append(problems, &IntegrityProblem{Kind: OrphanFlavor, Table: "flavors", Key: k.String(), Repaired: repair})
+	}
+
+	units, err := queryKeys(q, unitsTable, "select extractId, language, flavorType, flavorId, blockId, unitId from units u "+
+		"where not exists (select 1 from flavors f where f.extractId=u.extractId and f.language=u.language "+
+		"and f.flavorType=u.flavorType and f.flavorId=u.flavorId)", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range units {
+		if repair {
+			err = tx.DeleteVersioned("units", SystemAuthor, k)
+			if err != nil {
+				return nil, err
+			}
+		}
+		problems = append(problems, &IntegrityProblem{Kind: OrphanUnit, Table: "units", Key: k.String(), Repaired: repair})
+	}
+
+	for _, table := range []*database.Table{extractsTable, flavorsTable, unitsTable, slugAliasesTable} {
+		pk := strings.Join(table.PrimaryKey, ",")
+		gaps, err := queryKeys(q, table, fmt.Sprintf("select %s from %s group by %s having count(1)!=max(%s)+1",
+			pk, history(table.Name), pk, version(table.Name)), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range gaps {
+			problems = append(problems, &IntegrityProblem{Kind: VersionGap, Table: table.Name, Key: k.String()})
+		}
+	}
+
+	type extractRow struct {
+		eType    sql.NullString
+		metadata []byte
+	}
+	extractRows := make([]*extractRow, 0)
+	extracts, err := queryKeys(q, extractsTable, "select extractId, extractType, metadata from extracts", func() []interface{} {
+		r := new(extractRow)
+		extractRows = append(extractRows, r)
+		return []interface{}{&r.eType, &r.metadata}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range extracts {
+		r := extractRows[i]
+		if !r.eType.Valid {
+			problems = append(problems, &IntegrityProblem{Kind: InvalidExtractType, Table: "extracts", Key: k.String(), Detail: "NULL"})
+		} else if !content.ValidExtractType(content.ExtractType(r.eType.String)) {
+			problems = append(problems, &IntegrityProblem{Kind: InvalidExtractType, Table: "extracts", Key: k.String(), Detail: r.eType.String})
+		}
+		if err := json.Unmarshal(r.metadata, new(content.Metadata)); err != nil {
+			problems = append(problems, &IntegrityProblem{Kind: InvalidMetadata, Table: "extracts", Key: k.String(), Detail: err.Error()})
+		}
+	}
+
+	allFlavors, err := queryKeys(q, flavorsTable, "select extractId, language, flavorType, flavorId from flavors", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range allFlavors {
+		fType := k.values[2].(string)
+		if !content.ValidFlavorType(content.FlavorType(fType)) {
+			problems = append(problems, &IntegrityProblem{Kind: InvalidFlavorType, Table: "flavors", Key: k.String(), Detail: fType})
+		}
+	}
+
+	return problems, nil
+}
+
+// checkHistory reports the live rows of table without history, or whose last history entry is a deletion.
+// If tx is not nil, the current values of these rows are recorded in history.
+func checkHistory(q querier, table *database.Table, tx *Tx) ([]*IntegrityProblem, error) {
+	repair := tx != nil
+	match := make([]string, len(table.PrimaryKey))
+	for i, f := range table.PrimaryKey {
+		match[i] = fmt.Sprintf("h.%s=t.%s", f, f)
+	}
+	keys, err := queryKeys(q, table, fmt.Sprintf("select %s from %s t where not exists (select 1 from %s h where %s) "+
+		"or (select editType from %s h where %s order by %s desc limit 1)='%s'",
+		strings.Join(table.PrimaryKey, ","), table.Name, history(table.Name), strings.Join(match, " and "),
+		history(table.Name), strings.Join(match, " and "), version(table.Name), content.EditDelete), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]*IntegrityProblem, 0)
+	for _, k := range keys {
+		if repair {
+			v, err := tx.LatestVersion(table.Name, k)
+			if err != nil {
+				return nil, err
+			}
+			historyValues, err := tx.versionedValues(nil, SystemAuthor, v.Number+1, content.EditNew)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(recordHistorySql(table, k.Sql()), append(historyValues, k.Values()...)...)
+			if err != nil {
+				return nil, err
+			}
+		}
+		problems = append(problems, &IntegrityProblem{Kind: MissingHistory, Table: table.Name, Key: k.String(), Repaired: repair})
+	}
+	return problems, nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/database"
+)
+
+// ErrMetadataUnavailable is returned by extract queries with metadata conditions
+// when sqlite was built without JSON1 (build tag sqlite_json).
+var ErrMetadataUnavailable = errors.New("Metadata filters unavailable")
+
+// MetadataOp compares a metadata value.
+type MetadataOp string
+
+const (
+	MetadataEqual          MetadataOp = "="
+	MetadataNotEqual       MetadataOp = "!="
+	MetadataLess           MetadataOp = "<"
+	MetadataLessOrEqual    MetadataOp = "<="
+	MetadataGreater        MetadataOp = ">"
+	MetadataGreaterOrEqual MetadataOp = ">="
+)
+
+var metadataOps = map[MetadataOp]bool{
+	MetadataEqual: true, MetadataNotEqual: true,
+	MetadataLess: true, MetadataLessOrEqual: true,
+	MetadataGreater: true, MetadataGreaterOrEqual: true,
+}
+
+// MetadataCondition restricts the value of a top-level key of the extract metadata, as stored in JSON.
+// Value should be a string or a number, matching the JSON type of the key: "2001" does not equal 2001.
+// Extracts without the key never match.
+type MetadataCondition struct {
+	Key   string
+	Op    MetadataOp // defaults to MetadataEqual
+	Value interface{}
+}
+
+// IndexedMetadata lists the metadata keys indexed when opening the database.
+// Conditions on other keys read the metadata of every extract.
+var IndexedMetadata = []string{"Author", "Source", "Year", "Difficulty"}
+
+var metadataKeyRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// metadataSql returns the expression of the metadata value of key, for extracts e.
+// The path is a literal, so that indexes on it can be used.
+func metadataSql(key string) (string, error) {
+	if !metadataKeyRegexp.MatchString(key) {
+		return "", content.ErrInvalidInput
+	}
+	return fmt.Sprintf("json_extract(e.metadata, '$.%s')", key), nil
+}
+
+func (c *MetadataCondition) sql() (string, error) {
+	value, err := metadataSql(c.Key)
+	if err != nil {
+		return "", err
+	}
+	op := c.Op
+	if len(op) == 0 {
+		op = MetadataEqual
+	}
+	if !metadataOps[op] {
+		return "", content.ErrInvalidInput
+	}
+	switch c.Value.(type) {
+	case string, int, int64, float64:
+	default:
+		return "", content.ErrInvalidInput
+	}
+	return fmt.Sprintf("%s %s ?", value, op), nil
+}
+
+// createMetadataIndexes indexes the metadata keys listed in IndexedMetadata.
+// It tells whether metadata conditions can be evaluated, i.e. whether sqlite was built with JSON1.
+func createMetadataIndexes(db *database.DB) (bool, error) {
+	_, err := db.Exec("select json_extract('{}', '$.key')")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such function: json_extract") {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, key := range IndexedMetadata {
+		if !metadataKeyRegexp.MatchString(key) {
+			return true, fmt.Errorf("Invalid metadata key %q", key)
+		}
+		_, err := db.Exec(fmt.Sprintf("create index if not exists extracts_metadata_%s on extracts(json_extract(metadata, '$.%s'))", key, key))
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
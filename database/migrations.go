@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// migration is a change of the database schema.
+// The table definitions of this package describe the initial schema, which is created if missing.
+// Later changes are migrations, applied in order when the database is opened, each in its own transaction.
+// Released migrations must never be modified or reordered: new ones are appended with the next id.
+type migration struct {
+	Id   int
+	Name string
+	Up   func(tx *sql.Tx) error
+}
+
+var migrations = []*migration{{
+	Id:   1,
+	Name: "index history by time and author",
+	Up: func(tx *sql.Tx) error {
+		for _, table := range []string{"extracts", "flavors", "units", "slug_aliases"} {
+			for _, stmt := range []string{
+				"create index if not exists %s_time on %s(time)",
+				"create index if not exists %s_author on %s(author, time)",
+			} {
+				_, err := tx.Exec(fmt.Sprintf(stmt, history(table), history(table)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}}
+
+// MigrationStatus tells whether a migration was applied.
+type MigrationStatus struct {
+	Id   int
+	Name string
+	// Applied is zero for pending migrations.
+	Applied time.Time
+	// Error is the error of a failed dry run.
+	Error string
+}
+
+func createMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec("create table if not exists schema_migrations (id integer primary key, name text, applied integer)")
+	return err
+}
+
+// migrationStatus lists all known migrations, and whether they were applied.
+// It fails if the database has migrations unknown to this version of the server.
+func migrationStatus(db *sql.DB) ([]*MigrationStatus, error) {
+	applied := make(map[int]time.Time)
+	var exists int
+	err := db.QueryRow("select count(1) from sqlite_master where type='table' and name='schema_migrations'").Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	query := "select id, applied from schema_migrations"
+	if exists == 0 {
+		// All migrations are pending.
+		query = "select 0, 0 where 0"
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var date int64
+		err := rows.Scan(&id, &date)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[id] = time.Unix(date, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		list = append(list, &MigrationStatus{Id: m.Id, Name: m.Name, Applied: applied[m.Id]})
+		delete(applied, m.Id)
+	}
+	if len(applied) != 0 {
+		unknown := make([]int, 0, len(applied))
+		for id := range applied {
+			unknown = append(unknown, id)
+		}
+		sort.Ints(unknown)
+		return nil, fmt.Errorf("Database has unknown migrations %v: it was migrated by a newer server", unknown)
+	}
+	return list, nil
+}
+
+// migrate applies all pending migrations.
+// In a dry run, pending migrations are applied in a transaction which is rolled back,
+// and the error of the first failing migration is reported in its status.
+func migrate(db *sql.DB, dryRun bool) ([]*MigrationStatus, error) {
+	if !dryRun {
+		err := createMigrationsTable(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	list, err := migrationStatus(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var dryTx *sql.Tx
+	if dryRun {
+		dryTx, err = db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer dryTx.Rollback()
+	}
+	for i, m := range migrations {
+		status := list[i]
+		if !status.Applied.IsZero() {
+			continue
+		}
+		if dryRun {
+			err = m.Up(dryTx)
+			if err != nil {
+				status.Error = err.Error()
+				break
+			}
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		err = m.Up(tx)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Migration %d (%s) failed: %v", m.Id, m.Name, err)
+		}
+		now := time.Now()
+		_, err = tx.Exec("insert into schema_migrations values (?, ?, ?)", m.Id, m.Name, now.Unix())
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Applied migration %d: %s", m.Id, m.Name)
+		status.Applied = time.Unix(now.Unix(), 0)
+	}
+	return list, nil
+}
+
+// Migrations lists the schema migrations, and when they were applied.
+func (db *DB) Migrations() ([]*MigrationStatus, error) {
+	return migrationStatus(db.db.DB)
+}
+
+// PendingMigrations lists the schema migrations of a database file, without applying them.
+// If dryRun is true, pending migrations are tried and rolled back, and the error of the first failing one is reported.
+// This checks that a database, e.g. a copy of the production database, can be opened by this version of the server.
+func PendingMigrations(file string, dryRun bool) ([]*MigrationStatus, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if dryRun {
+		return migrate(db, true)
+	}
+	return migrationStatus(db)
+}
@@ -0,0 +1,25 @@
+package database
+
+// Paging selects a window of a result list.
+// A non-positive Limit means no limit.
+type Paging struct {
+	Offset int
+	Limit  int
+}
+
+// Sql returns the limit clause corresponding to p.
+func (p *Paging) Sql() string {
+	return " limit ? offset ?"
+}
+
+// Values returns the arguments of the limit clause returned by Sql.
+func (p *Paging) Values() []interface{} {
+	if p == nil {
+		return []interface{}{-1, 0}
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	return []interface{}{limit, p.Offset}
+}
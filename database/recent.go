@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// sessionGap is the longest pause between two edits of an author on an extract within one session.
+const sessionGap = 30 * time.Minute
+
+// ChangeLevel tells which part of an extract a change edits.
+type ChangeLevel string
+
+const (
+	ExtractChange ChangeLevel = "extract"
+	FlavorChange  ChangeLevel = "flavor"
+	UnitChange    ChangeLevel = "unit"
+)
+
+// Change is one version of an extract, a flavor or a unit.
+// Flavor is zero for extract changes, BlockId and UnitId are zero unless it is a unit change.
+type Change struct {
+	Level     ChangeLevel
+	ExtractId content.ExtractId
+	Flavor    FlavorKey
+	BlockId   content.BlockId
+	UnitId    content.UnitId
+	Version   *content.Version
+}
+
+// ChangeGroup is a session of changes of one author on one extract.
+type ChangeGroup struct {
+	ExtractId content.ExtractId
+	Author    user.Name
+	// Start and End are the times of the first and last changes of the session.
+	Start, End time.Time
+	// Changes are sorted newest first.
+	Changes []*Change
+}
+
+// RecentChanges lists the changes made since the given time, grouped per extract and author session,
+// latest sessions first. Edits of the same author on the same extract belong to one session
+// unless they are separated by more than half an hour.
+// If limit is positive, at most limit sessions are returned. The oldest of them may be cut at since.
+func (db *DB) RecentChanges(since time.Time, limit int) ([]*ChangeGroup, error) {
+	return db.RecentChangesContext(context.Background(), since, limit)
+}
+
+func (db *DB) RecentChangesContext(ctx context.Context, since time.Time, limit int) ([]*ChangeGroup, error) {
+	from := since.Unix()
+	rows, err := db.db.QueryContext(ctx, changesSql("time>=?"), from, from, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type session struct {
+		extractId content.ExtractId
+		author    user.Name
+	}
+	groups := make([]*ChangeGroup, 0)
+	open := make(map[session]*ChangeGroup)
+	for rows.Next() {
+		c, err := scanChange(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		key := session{c.ExtractId, c.Version.Author}
+		g, ok := open[key]
+		if ok && g.Start.Sub(c.Version.Time) <= sessionGap {
+			g.Start = c.Version.Time
+			g.Changes = append(g.Changes, c)
+			continue
+		}
+		if limit > 0 && len(groups) == limit {
+			if !sessionsOpen(groups, c.Version.Time) {
+				break
+			}
+			continue
+		}
+		g = &ChangeGroup{
+			ExtractId: key.extractId,
+			Author:    key.author,
+			Start:     c.Version.Time,
+			End:       c.Version.Time,
+			Changes:   []*Change{c},
+		}
+		open[key] = g
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// changesSql returns the query listing the changes of all levels satisfying cond, newest first.
+// Changes made in the same second are ordered by the sequence numbers of their transactions.
+// The condition is applied to each history table, so its arguments must be repeated three times.
+func changesSql(cond string) string {
+	return "select 'extract', extractId, '', '', 0, 0, 0, author, time, extracts_version, editType, seq " +
+		"from extracts_history where " + cond +
+		" union all select 'flavor', extractId, language, flavorType, flavorId, 0, 0, author, time, flavors_version, editType, seq " +
+		"from flavors_history where " + cond +
+		" union all select 'unit', extractId, language, flavorType, flavorId, blockId, unitId, author, time, units_version, editType, seq " +
+		"from units_history where " + cond +
+		" order by time desc, seq desc"
+}
+
+func scanChange(s scanner) (*Change, error) {
+	var level, extractId, lang, flavorType, author, editType string
+	var date, seq int64
+	c := &Change{Version: new(content.Version)}
+	err := s.Scan(&level, &extractId, &lang, &flavorType, &c.Flavor.Id, &c.BlockId, &c.UnitId,
+		&author, &date, &c.Version.Number, &editType, &seq)
+	if err != nil {
+		return nil, err
+	}
+	c.Level = ChangeLevel(level)
+	c.ExtractId = content.ExtractId(extractId)
+	c.Flavor.Language = language.Code(lang)
+	c.Flavor.Type = content.FlavorType(flavorType)
+	c.Version.Author = user.Name(author)
+	c.Version.Time = time.Unix(date, 0)
+	c.Version.EditType = content.EditType(editType)
+	return c, nil
+}
+
+// sessionsOpen tells whether a change at time t could still belong to one of the groups.
+func sessionsOpen(groups []*ChangeGroup, t time.Time) bool {
+	for _, g := range groups {
+		if g.Start.Sub(t) <= sessionGap {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/database"
+	"github.com/polyglottis/platform/language"
+)
+
+// ErrSearchUnavailable is returned by Search when sqlite was built without FTS5 (build tag sqlite_fts5).
+var ErrSearchUnavailable = errors.New("Full-text search unavailable")
+
+// The search index mirrors the content of the units table.
+// It is kept in sync by triggers, hence within the transactions writing units.
+// Units have no stable integer key (their rowids may change, e.g. after a VACUUM),
+// so each unit key is given a search id in units_search_ids, which is the rowid of its entry in the index.
+const searchTable = "units_search"
+
+// searchIdsTable is created last: an index without it predates search ids, and is rebuilt.
+const searchIdsTable = "units_search_ids"
+
+// unitKeyMatch matches the keys of the units of the given trigger row (new or old) with search ids.
+func unitKeyMatch(row string) string {
+	match := make([]string, len(unitsTable.PrimaryKey))
+	for i, key := range unitsTable.PrimaryKey {
+		match[i] = fmt.Sprintf("%s=%s.%s", key, row, key)
+	}
+	return strings.Join(match, " and ")
+}
+
+var searchSchema = []string{
+	"create virtual table if not exists units_search using fts5(" +
+		"content, extractId unindexed, language unindexed, flavorType unindexed, flavorId unindexed, " +
+		"blockId unindexed, unitId unindexed, tokenize='unicode61 remove_diacritics 2')",
+	// Triggers are recreated, so that older versions are replaced.
+	"drop trigger if exists units_search_insert",
+	"drop trigger if exists units_search_delete",
+	"drop trigger if exists units_search_update",
+	"create trigger units_search_insert after insert on units begin " + searchInsert + "; end",
+	"create trigger units_search_delete after delete on units begin " + searchDelete + "; end",
+	"create trigger units_search_update after update on units begin " + searchDelete + "; " + searchInsert + "; end",
+	"create table if not exists units_search_ids (id integer primary key, extractId text, language text, flavorType text, " +
+		"flavorId integer, blockId integer, unitId integer, unique (extractId, language, flavorType, flavorId, blockId, unitId))",
+}
+
+var searchInsert = "insert or ignore into units_search_ids (extractId, language, flavorType, flavorId, blockId, unitId) " +
+	"values (new.extractId, new.language, new.flavorType, new.flavorId, new.blockId, new.unitId); " +
+	"insert into units_search(rowid, content, extractId, language, flavorType, flavorId, blockId, unitId) " +
+	"select id, new.content, new.extractId, new.language, new.flavorType, new.flavorId, new.blockId, new.unitId " +
+	"from units_search_ids where " + unitKeyMatch("new")
+
+var searchDelete = "delete from units_search where rowid=(select id from units_search_ids where " + unitKeyMatch("old") + ")"
+
+// createSearchIndex creates the search index, and fills it if it did not exist.
+// It returns false if sqlite does not support FTS5.
+func createSearchIndex(db *database.DB) (bool, error) {
+	var exists int
+	err := db.QueryRow("select count(1) from sqlite_master where name=?", searchIdsTable).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	for _, stmt := range searchSchema {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	if exists == 0 {
+		err = fillSearchIndex(tx)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// fillSearchIndex replaces the content of the search index with the units.
+func fillSearchIndex(tx *database.Tx) error {
+	for _, stmt := range []string{
+		"delete from units_search",
+		"insert or ignore into units_search_ids (extractId, language, flavorType, flavorId, blockId, unitId) " +
+			"select extractId, language, flavorType, flavorId, blockId, unitId from units",
+		"insert into units_search(rowid, content, extractId, language, flavorType, flavorId, blockId, unitId) " +
+			"select i.id, u.content, u.extractId, u.language, u.flavorType, u.flavorId, u.blockId, u.unitId " +
+			"from units u join units_search_ids i using (extractId, language, flavorType, flavorId, blockId, unitId)",
+	} {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildSearchIndex rebuilds the search index from the units table.
+// This is needed if the index is out of sync with the units, e.g. after units were written without the triggers.
+func (db *DB) RebuildSearchIndex() error {
+	if !db.searchable {
+		return ErrSearchUnavailable
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fillSearchIndex(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchResult is a unit matching a search.
+type SearchResult struct {
+	ExtractId content.ExtractId
+	Flavor    FlavorKey
+	BlockId   content.BlockId
+	UnitId    content.UnitId
+	// Snippet is the part of the unit around the matching words.
+	Snippet []SnippetPart
+}
+
+// SnippetPart is a piece of a snippet. Highlight is true for matching words.
+type SnippetPart struct {
+	Text      string
+	Highlight bool
+}
+
+// Markers delimiting highlighted words in sqlite snippets, unlikely to appear in content.
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+	snippetTokens  = 16
+)
+
+// Search lists the units in language lang containing all the words of query, best matches first.
+// A word ending with '*' matches all words starting with it.
+// If limit is positive, at most limit results are returned.
+func (db *DB) Search(query string, lang language.Code, limit int) ([]*SearchResult, error) {
+	return db.SearchContext(context.Background(), query, lang, limit)
+}
+
+func (db *DB) SearchContext(ctx context.Context, query string, lang language.Code, limit int) ([]*SearchResult, error) {
+	if !db.searchable {
+		return nil, ErrSearchUnavailable
+	}
+	match := searchMatch(query)
+	if len(match) == 0 || len(lang) == 0 {
+		return nil, content.ErrInvalidInput
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.db.QueryContext(ctx, "select extractId, flavorType, flavorId, blockId, unitId, snippet(units_search, 0, ?, ?, '…', ?) "+
+		"from units_search where units_search match ? and language=? order by rank limit ?",
+		highlightStart, highlightEnd, snippetTokens, match, string(lang), limit)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*SearchResult, 0)
+	for rows.Next() {
+		var eId, fType, snippet string
+		r := &SearchResult{Flavor: FlavorKey{Language: lang}}
+		err := rows.Scan(&eId, &fType, &r.Flavor.Id, &r.BlockId, &r.UnitId, &snippet)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.ExtractId = content.ExtractId(eId)
+		r.Flavor.Type = content.FlavorType(fType)
+		r.Snippet = splitSnippet(snippet)
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// searchMatch turns the words of query into an FTS5 query, so that user input never is a syntax error.
+func searchMatch(query string) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(query) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if len(word) == 0 {
+			continue
+		}
+		term := `"` + strings.Replace(word, `"`, `""`, -1) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+func splitSnippet(snippet string) []SnippetPart {
+	parts := make([]SnippetPart, 0)
+	for len(snippet) != 0 {
+		i := strings.Index(snippet, highlightStart)
+		if i < 0 {
+			parts = append(parts, SnippetPart{Text: snippet})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, SnippetPart{Text: snippet[:i]})
+		}
+		snippet = snippet[i+len(highlightStart):]
+		j := strings.Index(snippet, highlightEnd)
+		if j < 0 {
+			j = len(snippet)
+		}
+		parts = append(parts, SnippetPart{Text: snippet[:j], Highlight: true})
+		snippet = strings.TrimPrefix(snippet[j:], highlightEnd)
+	}
+	return parts
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/database"
+	"github.com/polyglottis/platform/language"
+	"github.com/polyglottis/platform/user"
+)
+
+// slugAliasesTable records the former slugs of extracts, so that old links keep working.
+// Slugs are stored in lowercase.
+var slugAliasesTable = &database.Table{
+	Name: "slug_aliases",
+	Columns: database.Columns{{
+		Field:      "slug",
+		Type:       "text",
+		Constraint: "not null",
+	}, {
+		Field: "extractId",
+		Type:  "text",
+	}},
+	PrimaryKey: []string{"slug"},
+}
+
+type aliasUpdate struct {
+	// Field names must coincide with DB columns!
+	ExtractId string
+}
+
+// slugKey identifies a row of the slug_aliases table.
+type slugKey string
+
+func (k slugKey) Sql() string           { return "slug=?" }
+func (k slugKey) Values() []interface{} { return []interface{}{strings.ToLower(string(k))} }
+
+// RenameSlug changes the slug of an extract. The former slug is kept as an alias of the extract.
+// It fails with a *SlugTakenError if the new slug is the slug or a former slug of another extract.
+func (db *DB) RenameSlug(author user.Name, id content.ExtractId, newSlug string) error {
+	return db.RenameSlugContext(context.Background(), author, id, newSlug)
+}
+
+func (db *DB) RenameSlugContext(ctx context.Context, author user.Name, id content.ExtractId, newSlug string) error {
+	return db.renameSlug(ctx, author, id, newSlug, true)
+}
+
+func (db *DB) renameSlug(ctx context.Context, author user.Name, id content.ExtractId, newSlug string, keepAlias bool) error {
+	if valid, _ := content.ValidSlug(newSlug); !valid {
+		return content.ErrInvalidInput
+	}
+
+	return db.withExtractLock(ctx, id, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.checkSlug(newSlug, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		e := new(extractUpdate)
+		err = tx.QueryRow("select slug, extractType, metadata from extracts where extractId=?", string(id)).Scan(&e.Slug, &e.ExtractType, &e.Metadata)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if e.Slug == newSlug {
+			return tx.Rollback()
+		}
+
+		if !strings.EqualFold(e.Slug, newSlug) {
+			// the new slug may be a former slug of this extract
+			v, err := tx.LatestVersion("slug_aliases", slugKey(newSlug))
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if v.EditType != content.EditDelete {
+				err = tx.DeleteVersioned("slug_aliases", author, slugKey(newSlug))
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+
+			if keepAlias {
+				err = tx.InsertOrUpdateVersioned("slug_aliases", author, slugKey(e.Slug), &aliasUpdate{
+					ExtractId: string(id),
+				})
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+
+		e.Slug = newSlug
+		err = tx.InsertOrUpdateVersioned("extracts", author, newExtractId(id), e)
+		if err != nil {
+			tx.Rollback()
+			return slugError(err, newSlug)
+		}
+
+		return tx.Commit()
+	})
+}
+
+// checkSlug returns a *SlugTakenError if another extract than id uses the given slug,
+// currently or as a former slug (case insensitive).
+func (tx *Tx) checkSlug(slug string, id content.ExtractId) error {
+	var owner string
+	err := tx.QueryRow("select extractId from extracts where lower(slug)=lower(?) and extractId!=? union "+
+		"select extractId from slug_aliases where slug=lower(?) and extractId!=? limit 1",
+		slug, string(id), slug, string(id)).Scan(&owner)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+	return &SlugTakenError{
+		Slug:      slug,
+		ExtractId: content.ExtractId(owner),
+	}
+}
+
+// slugError turns violations of the unique slug index into a *SlugTakenError.
+func slugError(err error, slug string) error {
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique &&
+		strings.Contains(sqliteErr.Error(), "slug") {
+		return &SlugTakenError{Slug: slug}
+	}
+	return err
+}
+
+func createSlugIndex(db *database.DB) error {
+	_, err := db.Exec("create unique index if not exists extracts_lower_slug on extracts(lower(slug))")
+	return err
+}
+
+// SlugAliasMap returns the former slugs of all extracts, in lowercase.
+func (db *DB) SlugAliasMap() (map[string]content.ExtractId, error) {
+	rows, err := db.db.Query("select slug, extractId from slug_aliases")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]content.ExtractId)
+	for rows.Next() {
+		var slug, id string
+		err := rows.Scan(&slug, &id)
+		if err != nil {
+			return nil, err
+		}
+		m[slug] = content.ExtractId(id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExtractSlugAliases returns the former slugs of an extract, in lowercase.
+func (db *DB) ExtractSlugAliases(id content.ExtractId) ([]string, error) {
+	rows, err := db.db.Query("select slug from slug_aliases where extractId=?", string(id))
+	if err != nil {
+		return nil, err
+	}
+	aliases := make([]string, 0)
+	for rows.Next() {
+		var slug string
+		err := rows.Scan(&slug)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, slug)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// SlugCollision describes a lowercase slug used by several extracts.
+type SlugCollision struct {
+	Slug string
+	// ExtractIds lists the extracts currently using the slug, oldest first.
+	ExtractIds []content.ExtractId
+	// AliasOf lists the other extracts having used the slug formerly.
+	AliasOf []content.ExtractId
+	// Renamed holds the new slugs given by FixSlugCollisions.
+	Renamed map[content.ExtractId]string
+}
+
+// SlugCollisions lists the slugs used by several extracts.
+// Such collisions can only exist in databases created before slugs were unique.
+func (db *DB) SlugCollisions() ([]*SlugCollision, error) {
+	collisions := make([]*SlugCollision, 0)
+	bySlug := make(map[string]*SlugCollision)
+	get := func(slug string) *SlugCollision {
+		c, ok := bySlug[slug]
+		if !ok {
+			c = &SlugCollision{Slug: slug}
+			bySlug[slug] = c
+			collisions = append(collisions, c)
+		}
+		return c
+	}
+
+	rows, err := db.db.Query("select lower(e.slug), e.extractId from extracts e where lower(e.slug) in " +
+		"(select lower(slug) from extracts group by lower(slug) having count(1)>1) " +
+		"order by lower(e.slug), (select min(time) from extracts_history h where h.extractId=e.extractId), e.extractId")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var slug, id string
+		err := rows.Scan(&slug, &id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c := get(slug)
+		c.ExtractIds = append(c.ExtractIds, content.ExtractId(id))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.db.Query("select a.slug, e.extractId, a.extractId from slug_aliases a, extracts e " +
+		"where lower(e.slug)=a.slug and e.extractId!=a.extractId order by a.slug")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var slug, id, aliasId string
+		err := rows.Scan(&slug, &id, &aliasId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c := get(slug)
+		if len(c.ExtractIds) == 0 {
+			c.ExtractIds = []content.ExtractId{content.ExtractId(id)}
+		}
+		c.AliasOf = append(c.AliasOf, content.ExtractId(aliasId))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return collisions, nil
+}
+
+// FixSlugCollisions resolves all slug collisions, and creates the unique slug index.
+// The oldest extract keeps the slug, others get a numeric suffix, and conflicting former slugs are dropped.
+// All changes are versioned edits by SystemAuthor.
+func (db *DB) FixSlugCollisions() ([]*SlugCollision, error) {
+	return db.FixSlugCollisionsContext(context.Background())
+}
+
+func (db *DB) FixSlugCollisionsContext(ctx context.Context) ([]*SlugCollision, error) {
+	collisions, err := db.SlugCollisions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range collisions {
+		c.Renamed = make(map[content.ExtractId]string)
+		for _, id := range c.ExtractIds[1:] {
+			slug, err := db.ExtractSlug(id)
+			if err != nil {
+				return nil, err
+			}
+			for n := 2; ; n++ {
+				newSlug := fmt.Sprintf("%s-%d", slug, n)
+				err = db.renameSlug(ctx, SystemAuthor, id, newSlug, false)
+				if err == nil {
+					c.Renamed[id] = newSlug
+					break
+				} else if !errors.Is(err, ErrSlugTaken) {
+					return nil, err
+				}
+			}
+		}
+
+		if len(c.AliasOf) != 0 {
+			tx, err := db.BeginContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			err = tx.DeleteVersioned("slug_aliases", SystemAuthor, slugKey(c.Slug))
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			err = tx.Commit()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return collisions, createSlugIndex(db.db)
+}
+
+// SuggestSlug transliterates a title into a valid slug, in the given language.
+// A numeric suffix is appended if the slug is already used by an extract, currently or formerly.
+func (db *DB) SuggestSlug(title string, lang language.Code) (string, error) {
+	return db.suggestSlug(context.Background(), title, lang)
+}
+
+func (db *DB) suggestSlug(ctx context.Context, title string, lang language.Code) (string, error) {
+	return suggestSlug(func(query string, args ...interface{}) (*sql.Rows, error) {
+		return db.db.QueryContext(ctx, query, args...)
+	}, title, lang)
+}
+
+// suggestSlug suggests a slug within the transaction, so that no other transaction may take it before it is used.
+func (tx *Tx) suggestSlug(title string, lang language.Code) (string, error) {
+	return suggestSlug(tx.Query, title, lang)
+}
+
+func suggestSlug(query func(query string, args ...interface{}) (*sql.Rows, error), title string, lang language.Code) (string, error) {
+	base := slugify(title, lang)
+	if valid, _ := content.ValidSlug(base); !valid {
+		base = defaultSlug
+	}
+
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(base) + "-%"
+	rows, err := query(`select lower(slug) from extracts where lower(slug)=? or lower(slug) like ? escape '\' union `+
+		`select slug from slug_aliases where slug=? or slug like ? escape '\'`, base, pattern, base, pattern)
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		err := rows.Scan(&slug)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		taken[slug] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug, nil
+}
+
+// titleOf returns the title of an extract (the unit of block 1) in the first language having one, in alphabetical order.
+func titleOf(e *content.Extract) (string, language.Code, bool) {
+	langs := make([]string, 0, len(e.Flavors))
+	for lang := range e.Flavors {
+		langs = append(langs, string(lang))
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		fByType := e.Flavors[language.Code(lang)]
+		types := make([]string, 0, len(fByType))
+		for fType := range fByType {
+			types = append(types, string(fType))
+		}
+		sort.Strings(types)
+		for _, fType := range types {
+			for _, f := range fByType[content.FlavorType(fType)] {
+				if len(f.Blocks) != 0 && len(f.Blocks[0]) != 0 && len(strings.TrimSpace(f.Blocks[0][0].Content)) != 0 {
+					return f.Blocks[0][0].Content, language.Code(lang), true
+				}
+			}
+		}
+	}
+	return "", "", false
+}
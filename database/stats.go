@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"os"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+)
+
+// Counts counts live rows.
+type Counts struct {
+	// Extracts counts extracts; in a breakdown, the extracts having at least one flavor in the category.
+	Extracts int
+	Flavors  int
+	Units    int
+}
+
+// Stats describes the size of the database.
+type Stats struct {
+	Counts
+	ByLanguage   map[language.Code]*Counts
+	ByFlavorType map[content.FlavorType]*Counts
+	// HistoryRows counts the history entries of each versioned table.
+	HistoryRows map[string]int
+	// FileSize is zero for in-memory databases.
+	FileSize      int64
+	PageSize      int
+	PageCount     int
+	FreelistCount int
+}
+
+// Stats counts the rows of the database, and reports its size.
+func (db *DB) Stats() (*Stats, error) {
+	return db.StatsContext(context.Background())
+}
+
+func (db *DB) StatsContext(ctx context.Context) (*Stats, error) {
+	stats := &Stats{
+		ByLanguage:   make(map[language.Code]*Counts),
+		ByFlavorType: make(map[content.FlavorType]*Counts),
+		HistoryRows:  make(map[string]int),
+	}
+	err := db.db.QueryRowContext(ctx, "select (select count(1) from extracts), (select count(1) from flavors), "+
+		"(select count(1) from units)").Scan(&stats.Extracts, &stats.Flavors, &stats.Units)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, breakdown := range []struct {
+		column string
+		counts func(value string) *Counts
+	}{{
+		column: "language",
+		counts: func(value string) *Counts {
+			c, ok := stats.ByLanguage[language.Code(value)]
+			if !ok {
+				c = new(Counts)
+				stats.ByLanguage[language.Code(value)] = c
+			}
+			return c
+		},
+	}, {
+		column: "flavorType",
+		counts: func(value string) *Counts {
+			c, ok := stats.ByFlavorType[content.FlavorType(value)]
+			if !ok {
+				c = new(Counts)
+				stats.ByFlavorType[content.FlavorType(value)] = c
+			}
+			return c
+		},
+	}} {
+		err = db.countFacet(ctx, "select "+breakdown.column+", count(distinct extractId) from flavors group by "+breakdown.column, nil,
+			func(value string, n int) { breakdown.counts(value).Extracts = n })
+		if err != nil {
+			return nil, err
+		}
+		err = db.countFacet(ctx, "select "+breakdown.column+", count(1) from flavors group by "+breakdown.column, nil,
+			func(value string, n int) { breakdown.counts(value).Flavors = n })
+		if err != nil {
+			return nil, err
+		}
+		err = db.countFacet(ctx, "select "+breakdown.column+", count(1) from units group by "+breakdown.column, nil,
+			func(value string, n int) { breakdown.counts(value).Units = n })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range []string{"extracts", "flavors", "units", "slug_aliases"} {
+		var n int
+		err = db.db.QueryRowContext(ctx, "select count(1) from "+history(table)).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		stats.HistoryRows[table] = n
+	}
+
+	for pragma, dest := range map[string]*int{
+		"page_size":      &stats.PageSize,
+		"page_count":     &stats.PageCount,
+		"freelist_count": &stats.FreelistCount,
+	} {
+		err = db.db.QueryRowContext(ctx, "pragma "+pragma).Scan(dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var seq int
+	var name, file string
+	err = db.db.QueryRowContext(ctx, "pragma database_list").Scan(&seq, &name, &file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file) != 0 {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stats.FileSize = info.Size()
+	}
+	return stats, nil
+}
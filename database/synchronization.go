@@ -1,44 +1,206 @@
 package database
 
 import (
+	"context"
+	"fmt"
 	"sync"
 
 	"github.com/polyglottis/platform/content"
 	"github.com/polyglottis/platform/language"
 )
 
-type lock struct {
-	*sync.Mutex
+// lockTable holds one read-write lock per key.
+// Locks are created on demand, and dropped as soon as no goroutine holds or waits for them.
+// Waiting for a lock can be cancelled through a context.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*refLock
 }
 
-func newLock() *lock {
-	return &lock{
-		Mutex: new(sync.Mutex),
+// refLock is a read-write lock, protected by the mutex of its table.
+type refLock struct {
+	refs           int
+	readers        int
+	writer         bool
+	writersWaiting int
+	changed        chan struct{} // closed and replaced whenever the lock is released
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		locks: make(map[string]*refLock),
+	}
+}
+
+// acquire returns the lock corresponding to key, and registers the caller as a user of the lock.
+// t.mu must be held.
+func (t *lockTable) acquire(key string) *refLock {
+	l, ok := t.locks[key]
+	if !ok {
+		l = &refLock{changed: make(chan struct{})}
+		t.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release unregisters a user of the lock corresponding to key.
+// t.mu must be held.
+func (t *lockTable) release(key string, l *refLock) {
+	l.refs--
+	if l.refs == 0 {
+		delete(t.locks, key)
+	}
+}
+
+// wait waits until the lock changes or ctx is done. t.mu must be held, and is held again when wait returns.
+func (t *lockTable) wait(ctx context.Context, l *refLock) error {
+	changed := l.changed
+	t.mu.Unlock()
+	defer t.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *refLock) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (t *lockTable) Lock(ctx context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.acquire(key)
+	l.writersWaiting++
+	defer func() { l.writersWaiting-- }()
+	for l.writer || l.readers > 0 {
+		if err := t.wait(ctx, l); err != nil {
+			t.release(key, l)
+			l.notify() // readers may be waiting for this writer to give up
+			return err
+		}
+	}
+	l.writer = true
+	return nil
+}
+
+func (t *lockTable) Unlock(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.locks[key]
+	l.writer = false
+	l.notify()
+	t.release(key, l)
+}
+
+// RLock locks key in shared mode. Waiting writers take precedence over new readers.
+func (t *lockTable) RLock(ctx context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.acquire(key)
+	for l.writer || l.writersWaiting > 0 {
+		if err := t.wait(ctx, l); err != nil {
+			t.release(key, l)
+			return err
+		}
 	}
+	l.readers++
+	return nil
+}
+
+func (t *lockTable) RUnlock(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.locks[key]
+	l.readers--
+	if l.readers == 0 {
+		l.notify()
+	}
+	t.release(key, l)
+}
+
+func (t *lockTable) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.locks)
+}
+
+func flavorLockKey(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId) string {
+	return fmt.Sprintf("%s/%s/%s/%d", extractId, lang, flavorType, flavorId)
 }
 
-func (db *DB) withExtractLock(id content.ExtractId, todo func() error) error {
-	exists, err := db.ExtractExists(id)
+func (db *DB) withExtractLock(ctx context.Context, id content.ExtractId, todo func() error) error {
+	exists, err := db.extractExists(ctx, id)
 	if err != nil {
 		return err
 	} else if !exists {
 		return content.ErrNotFound
 	}
-	return db.withExtractLock_NoCheck(id, todo)
+	return db.withExtractLock_NoCheck(ctx, id, todo)
 }
 
-func (db *DB) withExtractLock_NoCheck(id content.ExtractId, todo func() error) error {
-	db.extractLock.Lock()
-	defer db.extractLock.Unlock()
+// databaseLockKey is the only key of the database lock table.
+const databaseLockKey = ""
+
+// withDatabaseLock locks the whole database exclusively, waiting for all extract and flavor locks to be released.
+func (db *DB) withDatabaseLock(ctx context.Context, todo func() error) error {
+	err := db.databaseLock.Lock(ctx, databaseLockKey)
+	if err != nil {
+		return err
+	}
+	defer db.databaseLock.Unlock(databaseLockKey)
+	return todo()
+}
+
+// withExtractLock_NoCheck locks the extract exclusively, including all its flavors.
+// The database is locked in shared mode.
+func (db *DB) withExtractLock_NoCheck(ctx context.Context, id content.ExtractId, todo func() error) error {
+	err := db.databaseLock.RLock(ctx, databaseLockKey)
+	if err != nil {
+		return err
+	}
+	defer db.databaseLock.RUnlock(databaseLockKey)
+
+	err = db.extractLocks.Lock(ctx, string(id))
+	if err != nil {
+		return err
+	}
+	defer db.extractLocks.Unlock(string(id))
 	return todo()
 }
 
-func (db *DB) withFlavorLock(extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId, todo func() error) error {
-	exists, err := db.FlavorExists(extractId, lang, flavorType, flavorId)
+// withFlavorLock locks the flavor exclusively, and its extract and the database in shared mode,
+// so that different flavors of the same extract can be written concurrently.
+func (db *DB) withFlavorLock(ctx context.Context, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType, flavorId content.FlavorId, todo func() error) error {
+	exists, err := db.flavorExists(ctx, extractId, lang, flavorType, flavorId)
 	if err != nil {
 		return err
 	} else if !exists {
 		return content.ErrNotFound
 	}
-	return db.withExtractLock_NoCheck(extractId, todo)
+
+	err = db.databaseLock.RLock(ctx, databaseLockKey)
+	if err != nil {
+		return err
+	}
+	defer db.databaseLock.RUnlock(databaseLockKey)
+
+	err = db.extractLocks.RLock(ctx, string(extractId))
+	if err != nil {
+		return err
+	}
+	defer db.extractLocks.RUnlock(string(extractId))
+
+	key := flavorLockKey(extractId, lang, flavorType, flavorId)
+	err = db.flavorLocks.Lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer db.flavorLocks.Unlock(key)
+
+	return todo()
 }
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExtractLocks(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	db.withExtractLock_NoCheck(ctx, "a", func() error {
+		go db.withExtractLock_NoCheck(ctx, "b", func() error {
+			close(done)
+			return nil
+		})
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("Locking another extract should not block")
+		}
+		return nil
+	})
+
+	blocked := make(chan struct{})
+	released := make(chan struct{})
+	db.withExtractLock_NoCheck(ctx, "a", func() error {
+		go func() {
+			db.withExtractLock_NoCheck(ctx, "a", func() error {
+				close(blocked)
+				return nil
+			})
+			close(released)
+		}()
+		select {
+		case <-blocked:
+			t.Error("Locking the same extract twice should block")
+		case <-time.After(10 * time.Millisecond):
+		}
+		return nil
+	})
+	<-released
+
+	if n := db.extractLocks.size(); n != 0 {
+		t.Errorf("Released locks should be dropped, %d left", n)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	err := db.withExtractLock_NoCheck(context.Background(), "a", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return db.withExtractLock_NoCheck(ctx, "a", func() error {
+			t.Error("Lock should not be acquired twice")
+			return nil
+		})
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// a writer giving up should let readers through
+	err = db.extractLocks.RLock(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = db.extractLocks.Lock(ctx, "a")
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	err = db.extractLocks.RLock(ctx, "a")
+	cancel()
+	if err != nil {
+		t.Errorf("Shared lock should be acquired, got %v", err)
+	}
+	db.extractLocks.RUnlock("a")
+	db.extractLocks.RUnlock("a")
+
+	if n := db.extractLocks.size(); n != 0 {
+		t.Errorf("Released locks should be dropped, %d left", n)
+	}
+}
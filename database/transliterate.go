@@ -0,0 +1,204 @@
+package database
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/polyglottis/platform/language"
+)
+
+// maxSlugLength is the maximum length of generated slugs, excluding numeric suffixes.
+const maxSlugLength = 60
+
+// defaultSlug is used when nothing of a title can be transliterated.
+const defaultSlug = "extract"
+
+// slugify transliterates a title to ASCII, and turns it into a lowercase slug made of words separated by dashes.
+// Characters which cannot be transliterated (such as kanji) separate words.
+func slugify(title string, lang language.Code) string {
+	runes := []rune(strings.ToLower(title))
+	overrides := languageTransliterations[lang]
+
+	var b strings.Builder
+	dash := false
+	write := func(s string) {
+		if len(s) == 0 {
+			return
+		}
+		if dash && b.Len() != 0 {
+			b.WriteByte('-')
+		}
+		dash = false
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if s, ok := overrides[r]; ok {
+			write(s)
+			continue
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			write(string(r))
+			continue
+		}
+		if s, ok := transliterations[r]; ok {
+			write(s)
+			continue
+		}
+		if s, ok := polytonicGreek(r); ok {
+			write(s)
+			continue
+		}
+		if k := toHiragana(r); isKana(k) {
+			var s string
+			s, i = romajiAt(runes, i)
+			write(s)
+			continue
+		}
+		if unicode.Is(unicode.Mn, r) {
+			continue // combining accents
+		}
+		dash = true
+	}
+
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+		if i := strings.LastIndexByte(slug, '-'); i > maxSlugLength/2 {
+			slug = slug[:i]
+		}
+		slug = strings.TrimRight(slug, "-")
+	}
+	if len(slug) == 0 {
+		return defaultSlug
+	}
+	return slug
+}
+
+var languageTransliterations = map[language.Code]map[rune]string{
+	"de": {'ä': "ae", 'ö': "oe", 'ü': "ue"},
+	"uk": {'г': "h", 'и': "y", 'і': "i", 'ї': "yi", 'є': "ye"},
+}
+
+var transliterations = map[rune]string{
+	// Latin
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e", 'ğ': "g",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'œ': "oe", 'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ș': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'ț': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u", 'ý': "y", 'ÿ': "y",
+	'ź': "z", 'ż': "z", 'ž': "z",
+
+	// Cyrillic
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'ґ': "g", 'д': "d", 'е': "e", 'ё': "yo", 'є': "ye", 'ж': "zh",
+	'з': "z", 'и': "i", 'і': "i", 'ї': "yi", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh",
+	'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+
+	// Greek
+	'α': "a", 'ά': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'έ': "e", 'ζ': "z", 'η': "i", 'ή': "i",
+	'θ': "th", 'ι': "i", 'ί': "i", 'ϊ': "i", 'ΐ': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x",
+	'ο': "o", 'ό': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'ύ': "y", 'ϋ': "y",
+	'ΰ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o", 'ώ': "o",
+}
+
+// polytonicGreek transliterates the lowercase vowels with breathings and accents of the Greek Extended block.
+func polytonicGreek(r rune) (string, bool) {
+	switch {
+	case r >= 'ἀ' && r <= 'ἇ', r >= 'ᾀ' && r <= 'ᾇ', r >= 'ᾰ' && r <= 'ᾷ', r == 'ὰ' || r == 'ά':
+		return "a", true
+	case r >= 'ἐ' && r <= 'ἕ', r == 'ὲ' || r == 'έ':
+		return "e", true
+	case r >= 'ἠ' && r <= 'ἧ', r >= 'ᾐ' && r <= 'ᾗ', r >= 'ῂ' && r <= 'ῇ', r == 'ὴ' || r == 'ή':
+		return "i", true
+	case r >= 'ἰ' && r <= 'ἷ', r >= 'ῐ' && r <= 'ῗ', r == 'ὶ' || r == 'ί':
+		return "i", true
+	case r >= 'ὀ' && r <= 'ὅ', r == 'ὸ' || r == 'ό':
+		return "o", true
+	case r == 'ῤ' || r == 'ῥ':
+		return "r", true
+	case r >= 'ὐ' && r <= 'ὗ', r >= 'ῠ' && r <= 'ῧ', r == 'ὺ' || r == 'ύ':
+		return "y", true
+	case r >= 'ὠ' && r <= 'ὧ', r >= 'ᾠ' && r <= 'ᾧ', r >= 'ῲ' && r <= 'ῷ', r == 'ὼ' || r == 'ώ':
+		return "o", true
+	}
+	return "", false
+}
+
+var romaji = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n", 'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o", 'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゎ': "wa",
+}
+
+// toHiragana maps katakana to the corresponding hiragana.
+func toHiragana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - ('ァ' - 'ぁ')
+	}
+	return r
+}
+
+func isKana(r rune) bool {
+	_, ok := romaji[r]
+	return ok || r == 'っ' || r == 'ー'
+}
+
+// romajiAt transliterates the kana at position i, possibly combined with the following small kana,
+// and returns the position of the last rune used.
+func romajiAt(runes []rune, i int) (string, int) {
+	r := toHiragana(runes[i])
+	switch r {
+	case 'ー': // long vowel mark
+		return "", i
+	case 'っ': // small tsu doubles the next consonant
+		if i+1 < len(runes) {
+			if next, ok := romaji[toHiragana(runes[i+1])]; ok && len(next) > 1 {
+				s, j := romajiAt(runes, i+1)
+				if strings.HasPrefix(s, "ch") {
+					return "t" + s, j
+				}
+				return s[:1] + s, j
+			}
+		}
+		return "", i
+	}
+
+	s := romaji[r]
+	if i+1 < len(runes) && strings.HasSuffix(s, "i") && len(s) > 1 {
+		var y string
+		switch toHiragana(runes[i+1]) {
+		case 'ゃ':
+			y = "a"
+		case 'ゅ':
+			y = "u"
+		case 'ょ':
+			y = "o"
+		}
+		if len(y) != 0 {
+			switch s {
+			case "shi", "chi", "ji":
+				return s[:len(s)-1] + y, i + 1
+			default:
+				return s[:len(s)-1] + "y" + y, i + 1
+			}
+		}
+	}
+	return s, i
+}
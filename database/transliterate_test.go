@@ -0,0 +1,95 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, test := range []struct {
+		title string
+		lang  language.Code
+		slug  string
+	}{
+		{"The Little Prince", "en", "the-little-prince"},
+		{"  L'Étranger!  ", "fr", "l-etranger"},
+		{"Die Bürgschaft", "de", "die-buergschaft"},
+		{"Die Bürgschaft", "en", "die-burgschaft"},
+		{"Преступление и наказание", "ru", "prestuplenie-i-nakazanie"},
+		{"Кобзар", "uk", "kobzar"},
+		{"Ὀδύσσεια", "el", "odysseia"},
+		{"Οδύσσεια", "el", "odysseia"},
+		{"きょうは いい てんき", "ja", "kyouha-ii-tenki"},
+		{"マッチ売りの少女", "ja", "matchi-rino"},
+		{"ざっし", "ja", "zasshi"},
+		{"吾輩は猫である", "ja", "ha-dearu"},
+		{"羅生門", "ja", defaultSlug},
+		{"???", "en", defaultSlug},
+	} {
+		if slug := slugify(test.title, test.lang); slug != test.slug {
+			t.Errorf("slugify(%q, %s) = %q, expected %q", test.title, test.lang, slug, test.slug)
+		}
+	}
+
+	if slug := slugify(strings.Repeat("word ", 50), "en"); len(slug) > maxSlugLength || strings.HasSuffix(slug, "-") {
+		t.Errorf("Long titles should be truncated at a word boundary: %q", slug)
+	}
+}
+
+func TestSuggestSlug(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	insertTestExtract(t, db, "extract1", "Kobzar", nil)
+	insertTestExtract(t, db, "extract2", "kobzar-2", nil)
+	insertTestExtract(t, db, "extract3", "kobzar_3", nil)
+
+	slug, err := db.SuggestSlug("Кобзар", "uk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slug != "kobzar-3" {
+		t.Errorf("Expected kobzar-3, got %s", slug)
+	}
+}
+
+func TestNewExtractSuggestsSlug(t *testing.T) {
+	db := openTestDB(t)
+	defer closeTestDB(db)
+
+	// Extracts created concurrently with the same title get distinct slugs.
+	const n = 8
+	slugs := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e := &content.Extract{
+				Type: "story",
+				Flavors: content.FlavorMap{"uk": content.FlavorByType{"text": {{
+					Blocks: content.BlockSlice{{{Content: "Кобзар"}}},
+				}}}},
+			}
+			err := db.NewExtract(testAuthor, e)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			slugs[i] = e.UrlSlug
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Strings(slugs)
+	expected := []string{"kobzar", "kobzar-2", "kobzar-3", "kobzar-4", "kobzar-5", "kobzar-6", "kobzar-7", "kobzar-8"}
+	if !reflect.DeepEqual(slugs, expected) {
+		t.Errorf("Expected slugs %v, got %v", expected, slugs)
+	}
+}
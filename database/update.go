@@ -1,13 +1,23 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
 	"github.com/polyglottis/platform/user"
 )
 
 func (db *DB) UpdateExtract(author user.Name, e *content.Extract) error {
+	return db.UpdateExtractContext(context.Background(), author, e)
+}
+
+func (db *DB) UpdateExtractContext(ctx context.Context, author user.Name, e *content.Extract) error {
+	return db.updateExtract(ctx, author, e, anyVersion)
+}
+
+func (db *DB) updateExtract(ctx context.Context, author user.Name, e *content.Extract, expected int) error {
 	if !content.ValidExtractType(e.Type) {
 		return content.ErrInvalidInput
 	}
@@ -17,12 +27,19 @@ func (db *DB) UpdateExtract(author user.Name, e *content.Extract) error {
 		return err
 	}
 
-	return db.withExtractLock(e.Id, func() error {
-		tx, err := db.Begin()
+	return db.withExtractLock(ctx, e.Id, func() error {
+		tx, err := db.BeginContext(ctx)
 		if err != nil {
 			return err
 		}
 
+		extractId := newExtractId(e.Id)
+		err = tx.checkVersion("extracts", extractId, expected)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
 		// get current slug, to make sure it stays the same as before
 		var slug string
 		err = tx.QueryRow("select slug from extracts where extractId=?", string(e.Id)).Scan(&slug)
@@ -31,7 +48,7 @@ func (db *DB) UpdateExtract(author user.Name, e *content.Extract) error {
 			return err
 		}
 
-		err = tx.InsertOrUpdateVersioned("extracts", author, newExtractId(e.Id), &extractUpdate{
+		err = tx.InsertOrUpdateVersioned("extracts", author, extractId, &extractUpdate{
 			Slug:        slug,
 			ExtractType: string(e.Type),
 			Metadata:    metadata,
@@ -46,13 +63,28 @@ func (db *DB) UpdateExtract(author user.Name, e *content.Extract) error {
 }
 
 func (db *DB) UpdateFlavor(author user.Name, f *content.Flavor) error {
-	return db.withFlavorLock(f.ExtractId, f.Language, f.Type, f.Id, func() error {
-		tx, err := db.Begin()
+	return db.UpdateFlavorContext(context.Background(), author, f)
+}
+
+func (db *DB) UpdateFlavorContext(ctx context.Context, author user.Name, f *content.Flavor) error {
+	return db.updateFlavor(ctx, author, f, anyVersion)
+}
+
+func (db *DB) updateFlavor(ctx context.Context, author user.Name, f *content.Flavor, expected int) error {
+	return db.withFlavorLock(ctx, f.ExtractId, f.Language, f.Type, f.Id, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		id := newFlavorId(f.ExtractId, f.Language, f.Type, f.Id)
+		err = tx.checkVersion("flavors", id, expected)
 		if err != nil {
+			tx.Rollback()
 			return err
 		}
 
-		err = tx.InsertOrUpdateVersioned("flavors", author, newFlavorId(f.ExtractId, f.Language, f.Type, f.Id), &flavorUpdate{
+		err = tx.InsertOrUpdateVersioned("flavors", author, id, &flavorUpdate{
 			LanguageComment: f.LanguageComment,
 			Summary:         f.Summary,
 		})
@@ -66,6 +98,16 @@ func (db *DB) UpdateFlavor(author user.Name, f *content.Flavor) error {
 }
 
 func (db *DB) InsertOrUpdateUnits(author user.Name, units []*content.Unit) error {
+	return db.InsertOrUpdateUnitsContext(context.Background(), author, units)
+}
+
+func (db *DB) InsertOrUpdateUnitsContext(ctx context.Context, author user.Name, units []*content.Unit) error {
+	return db.insertOrUpdateUnits(ctx, author, units, nil)
+}
+
+// insertOrUpdateUnits inserts or updates the given units.
+// Each unit found in expected must be at the version given by expected.
+func (db *DB) insertOrUpdateUnits(ctx context.Context, author user.Name, units []*content.Unit, expected map[UnitKey]int) error {
 	if len(units) == 0 {
 		return nil
 	}
@@ -85,14 +127,25 @@ func (db *DB) InsertOrUpdateUnits(author user.Name, units []*content.Unit) error
 		}
 	}
 
-	return db.withFlavorLock(extractId, lang, flavorType, flavorId, func() error {
-		tx, err := db.Begin()
+	return db.withFlavorLock(ctx, extractId, lang, flavorType, flavorId, func() error {
+		tx, err := db.BeginContext(ctx)
 		if err != nil {
 			return err
 		}
 
 		for _, u := range units {
-			err := tx.InsertOrUpdateVersioned("units", author, newUnitId(extractId, lang, flavorType, flavorId, u.BlockId, u.Id), &unitUpdate{
+			id := newUnitId(extractId, lang, flavorType, flavorId, u.BlockId, u.Id)
+			v, ok := expected[unitKey(u)]
+			if !ok {
+				v = anyVersion
+			}
+			err := tx.checkVersion("units", id, v)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			err = tx.InsertOrUpdateVersioned("units", author, id, &unitUpdate{
 				ContentType: string(u.ContentType),
 				Content:     u.Content,
 			})
@@ -104,3 +157,89 @@ func (db *DB) InsertOrUpdateUnits(author user.Name, units []*content.Unit) error
 		return tx.Commit()
 	})
 }
+
+// RevertExtract restores the type and metadata of the given version of an extract.
+// The slug is left unchanged.
+func (db *DB) RevertExtract(author user.Name, id content.ExtractId, number int) error {
+	return db.RevertExtractContext(context.Background(), author, id, number)
+}
+
+func (db *DB) RevertExtractContext(ctx context.Context, author user.Name, id content.ExtractId, number int) error {
+	return db.withExtractLock(ctx, id, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		var slug string
+		err = tx.QueryRow("select slug from extracts where extractId=?", string(id)).Scan(&slug)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		old := new(extractUpdate)
+		err = tx.scanVersioned("extracts", newExtractId(id), number, old)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		old.Slug = slug
+
+		err = tx.insertOrUpdateVersioned("extracts", author, newExtractId(id), old, EditRevert)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// RevertFlavor restores the language comment and summary of the given version of a flavor.
+func (db *DB) RevertFlavor(author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType,
+	flavorId content.FlavorId, number int) error {
+	return db.RevertFlavorContext(context.Background(), author, extractId, lang, flavorType, flavorId, number)
+}
+
+func (db *DB) RevertFlavorContext(ctx context.Context, author user.Name, extractId content.ExtractId, lang language.Code,
+	flavorType content.FlavorType, flavorId content.FlavorId, number int) error {
+	return db.withFlavorLock(ctx, extractId, lang, flavorType, flavorId, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.RevertVersioned("flavors", author, newFlavorId(extractId, lang, flavorType, flavorId), number, new(flavorUpdate))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// RevertUnit restores the given version of a unit.
+func (db *DB) RevertUnit(author user.Name, extractId content.ExtractId, lang language.Code, flavorType content.FlavorType,
+	flavorId content.FlavorId, blockId content.BlockId, unitId content.UnitId, number int) error {
+	return db.RevertUnitContext(context.Background(), author, extractId, lang, flavorType, flavorId, blockId, unitId, number)
+}
+
+func (db *DB) RevertUnitContext(ctx context.Context, author user.Name, extractId content.ExtractId, lang language.Code,
+	flavorType content.FlavorType, flavorId content.FlavorId, blockId content.BlockId, unitId content.UnitId, number int) error {
+	return db.withFlavorLock(ctx, extractId, lang, flavorType, flavorId, func() error {
+		tx, err := db.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.RevertVersioned("units", author, newUnitId(extractId, lang, flavorType, flavorId, blockId, unitId), number, new(unitUpdate))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
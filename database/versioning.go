@@ -45,21 +45,119 @@ func addVersionedTable(schema database.Schema, table *database.Table) database.S
 	})
 }
 
+// versionedTables are the versioned tables, by name.
+var versionedTables = map[string]*database.Table{
+	extractsTable.Name:    extractsTable,
+	flavorsTable.Name:     flavorsTable,
+	unitsTable.Name:       unitsTable,
+	slugAliasesTable.Name: slugAliasesTable,
+}
+
+// historyColumns returns the columns of the history of table.
+// Statements name their columns, so that migrations may add columns to the tables.
+func historyColumns(table *database.Table) []string {
+	return append(columnNames(table), versioningColumns(table.Name)...)
+}
+
+// versioningColumns returns the versioning columns of the history of a table,
+// followed by the sequence number added by numberHistory.
+func versioningColumns(tableName string) []string {
+	return append(columnNames(&database.Table{Columns: versioning(tableName)}), "seq")
+}
+
+func insertSql(table string, columns []string) string {
+	return fmt.Sprintf("insert into %s (%s) values %s", table, strings.Join(columns, ", "), database.QM(len(columns)))
+}
+
+// recordHistorySql returns a statement copying the rows of table matching the where clause into its history.
+// Its arguments are the versioning values, followed by the arguments of the where clause.
+func recordHistorySql(table *database.Table, where string) string {
+	return fmt.Sprintf("insert into %s (%s) select %s, ?, ?, ?, ?, ? from %s where %s", history(table.Name),
+		strings.Join(historyColumns(table), ", "), strings.Join(columnNames(table), ", "), table.Name, where)
+}
+
+// InsertVersioned inserts a new row, with values in the order of the columns of the table definition.
 func (tx *Tx) InsertVersioned(table string, author user.Name, values ...interface{}) error {
+	t, ok := versionedTables[table]
+	if !ok {
+		return fmt.Errorf("Unknown versioned table %s", table)
+	}
+
 	// update main table
-	_, err := tx.Exec(fmt.Sprintf("insert into %s values %s", table, database.QM(len(values))), values...)
+	_, err := tx.Exec(insertSql(table, columnNames(t)), values...)
 	if err != nil {
 		return err
 	}
 
 	// insert history entry
-	historyValues := versionedValues(values, author, 0, content.EditNew)
-	_, err = tx.Exec(fmt.Sprintf("insert into %s values %s", history(table), database.QM(len(historyValues))), historyValues...)
+	historyValues, err := tx.versionedValues(values, author, 0, content.EditNew)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertSql(history(table), historyColumns(t)), historyValues...)
 	return err
 }
 
-func versionedValues(values []interface{}, author user.Name, version int, t content.EditType) []interface{} {
-	return append(values, string(author), time.Now().Unix(), version, string(t))
+func (tx *Tx) versionedValues(values []interface{}, author user.Name, version int, t content.EditType) ([]interface{}, error) {
+	seq, err := tx.sequence()
+	if err != nil {
+		return nil, err
+	}
+	return append(values, string(author), tx.time, version, string(t), seq), nil
+}
+
+// sequence returns the sequence number of the history entries of the transaction.
+// Sequence numbers order transactions, whereas several transactions may share the same time.
+// Transactions take the write lock when they start, so no other transaction may take the same number.
+func (tx *Tx) sequence() (int64, error) {
+	if tx.seq != 0 {
+		return tx.seq, nil
+	}
+	var seq int64
+	err := tx.QueryRow("select coalesce(max(seq), 0) + 1 from (select max(seq) seq from extracts_history " +
+		"union all select max(seq) from flavors_history union all select max(seq) from units_history " +
+		"union all select max(seq) from slug_aliases_history)").Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	tx.seq = seq
+	return seq, nil
+}
+
+// numberHistory adds sequence numbers to the history tables, unless they have them already.
+// Earlier entries are numbered by time: entries sharing the same time share the same number.
+func numberHistory(db *sql.DB) error {
+	var numbered int
+	err := db.QueryRow("select count(1) from pragma_table_info(?) where name='seq'", history(extractsTable.Name)).Scan(&numbered)
+	if err != nil || numbered != 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmts := []string{
+		"create temp table history_times (seq integer primary key, time integer unique)",
+		"insert into temp.history_times (time) select distinct time from (select time from extracts_history " +
+			"union select time from flavors_history union select time from units_history union select time from slug_aliases_history) " +
+			"order by time",
+	}
+	for _, table := range []string{"extracts", "flavors", "units", "slug_aliases"} {
+		stmts = append(stmts,
+			fmt.Sprintf("alter table %s add column seq integer", history(table)),
+			fmt.Sprintf("update %s set seq=(select t.seq from temp.history_times t where t.time=%[1]s.time)", history(table)),
+			fmt.Sprintf("create index %s_seq on %[1]s(seq)", history(table)))
+	}
+	stmts = append(stmts, "drop table temp.history_times")
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (tx *Tx) InsertVersionedFlavor(author user.Name, f *content.Flavor) error {
@@ -84,24 +182,32 @@ func (tx *Tx) InsertVersionedFlavor(author user.Name, f *content.Flavor) error {
 }
 
 type extractUpdate struct {
-	// Order and field names must coincide with DB columns!
+	// Field names must coincide with DB columns!
 	Slug        string
 	ExtractType string
 	Metadata    []byte
 }
 
 type flavorUpdate struct {
-	// Order and field names must coincide with DB columns!
-	Summary         string
+	// Field names must coincide with DB columns!
 	LanguageComment string
+	Summary         string
 }
 
 type unitUpdate struct {
-	// Order and field names must coincide with DB columns!
+	// Field names must coincide with DB columns!
 	ContentType string
 	Content     string
 }
 
+// rowKey identifies rows of a versioned table.
+type rowKey interface {
+	// Sql returns the where clause selecting the rows.
+	Sql() string
+	// Values returns the arguments of the where clause.
+	Values() []interface{}
+}
+
 type primaryKey struct {
 	// Order and field names must coincide with DB columns!
 	ExtractId  string
@@ -145,6 +251,11 @@ func (pk *primaryKey) Values() []interface{} {
 	return list
 }
 
+// fields returns pointers to the fields of pk, in column order.
+func (pk *primaryKey) fields() []interface{} {
+	return []interface{}{&pk.ExtractId, &pk.Language, &pk.FlavorType, &pk.FlavorId, &pk.BlockId, &pk.UnitId}
+}
+
 func newExtractId(id content.ExtractId) *primaryKey {
 	return &primaryKey{
 		ExtractId: string(id),
@@ -171,7 +282,18 @@ func newUnitId(extractId content.ExtractId, lang language.Code, flavorType conte
 	}
 }
 
-func (tx *Tx) InsertOrUpdateVersioned(table string, author user.Name, id *primaryKey, kvPairs interface{}) error {
+// EditRevert is the edit type of history entries restoring an earlier version.
+const EditRevert content.EditType = "revert"
+
+func (tx *Tx) InsertOrUpdateVersioned(table string, author user.Name, id rowKey, kvPairs interface{}) error {
+	return tx.insertOrUpdateVersioned(table, author, id, kvPairs, content.EditUpdate)
+}
+
+func (tx *Tx) insertOrUpdateVersioned(table string, author user.Name, id rowKey, kvPairs interface{}, editType content.EditType) error {
+	tableDef, ok := versionedTables[table]
+	if !ok {
+		return fmt.Errorf("Unknown versioned table %s", table)
+	}
 	curVersion, err := tx.LatestVersion(table, id)
 	if err != nil {
 		return err
@@ -183,37 +305,194 @@ func (tx *Tx) InsertOrUpdateVersioned(table string, author user.Name, id *primar
 	columns := make([]string, t.NumField())
 	values := make([]interface{}, t.NumField(), t.NumField()+4)
 	for i := range columns {
-		columns[i] = t.Field(i).Name + "=?"
+		columns[i] = t.Field(i).Name
 		values[i] = v.Field(i).Interface()
 	}
 	idValues := id.Values()
+	insertColumns := append(tableDef.PrimaryKey[:len(idValues):len(idValues)], columns...)
 
 	// update main table
 	insertValues := append(idValues, values...)
-	if curVersion.Number == -1 {
-		_, err = tx.Exec(fmt.Sprintf("insert into %s values %s", table, database.QM(len(insertValues))), insertValues...)
+	if curVersion.EditType == content.EditDelete { // never existed, or deleted
+		_, err = tx.Exec(insertSql(table, insertColumns), insertValues...)
 		if err != nil {
 			return err
 		}
 	} else {
 		updateValues := append(values, idValues...)
-		_, err = tx.Exec(fmt.Sprintf("update %s set %s where %s", table, strings.Join(columns, ","), id.Sql()), updateValues...)
+		_, err = tx.Exec(fmt.Sprintf("update %s set %s=? where %s", table, strings.Join(columns, "=?, "), id.Sql()), updateValues...)
 		if err != nil {
 			return err
 		}
 	}
 
 	// insert history entry
-	editType := content.EditUpdate
 	if curVersion.EditType == content.EditDelete {
 		editType = content.EditNew
 	}
-	historyValues := versionedValues(insertValues, author, curVersion.Number+1, editType)
-	_, err = tx.Exec(fmt.Sprintf("insert into %s values %s", history(table), database.QM(len(historyValues))), historyValues...)
+	historyValues, err := tx.versionedValues(insertValues, author, curVersion.Number+1, editType)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertSql(history(table), append(insertColumns, versioningColumns(table)...)), historyValues...)
+	return err
+}
+
+// RevertVersioned restores the given version of a row, recording the change as a new version with edit type EditRevert.
+// kvPairs should point to the update struct corresponding to the table.
+func (tx *Tx) RevertVersioned(table string, author user.Name, id rowKey, number int, kvPairs interface{}) error {
+	err := tx.scanVersioned(table, id, number, kvPairs)
+	if err != nil {
+		return err
+	}
+	return tx.insertOrUpdateVersioned(table, author, id, kvPairs, EditRevert)
+}
+
+// scanVersioned reads the fields of kvPairs from the given version of a row.
+// It returns content.ErrNotFound if the version does not exist, and content.ErrInvalidInput if it is a deletion.
+func (tx *Tx) scanVersioned(table string, id rowKey, number int, kvPairs interface{}) error {
+	v := reflect.ValueOf(kvPairs).Elem()
+	t := v.Type()
+	columns := make([]string, t.NumField())
+	dest := make([]interface{}, t.NumField(), t.NumField()+1)
+	for i := range columns {
+		columns[i] = t.Field(i).Name
+		dest[i] = v.Field(i).Addr().Interface()
+	}
+	var editType string
+	dest = append(dest, &editType)
+
+	err := tx.QueryRow(fmt.Sprintf("select %s, editType from %s where %s and %s=?",
+		strings.Join(columns, ","), history(table), id.Sql(), version(table)), append(id.Values(), number)...).Scan(dest...)
+	switch {
+	case err == sql.ErrNoRows:
+		return content.ErrNotFound
+	case err != nil:
+		return err
+	case content.EditType(editType) == content.EditDelete:
+		return content.ErrInvalidInput
+	}
+	return nil
+}
+
+// DeleteVersioned removes a row from the main table, and records its last values in a tombstone history entry.
+// It returns content.ErrNotFound if the row does not exist.
+func (tx *Tx) DeleteVersioned(table string, author user.Name, id rowKey) error {
+	tableDef, ok := versionedTables[table]
+	if !ok {
+		return fmt.Errorf("Unknown versioned table %s", table)
+	}
+	curVersion, err := tx.LatestVersion(table, id)
+	if err != nil {
+		return err
+	}
+	if curVersion.EditType == content.EditDelete {
+		return content.ErrNotFound
+	}
+
+	// insert history entry
+	historyValues, err := tx.versionedValues(nil, author, curVersion.Number+1, content.EditDelete)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(recordHistorySql(tableDef, id.Sql()), append(historyValues, id.Values()...)...)
+	if err != nil {
+		return err
+	}
+
+	// update main table
+	_, err = tx.Exec(fmt.Sprintf("delete from %s where %s", table, id.Sql()), id.Values()...)
 	return err
 }
 
-func (tx *Tx) LatestVersion(table string, id *primaryKey) (*content.Version, error) {
+// deleteVersionedAll deletes all rows of the given table whose primary key starts with prefix.
+func (tx *Tx) deleteVersionedAll(table *database.Table, author user.Name, prefix *primaryKey) error {
+	rows, err := tx.Query(fmt.Sprintf("select %s from %s where %s", strings.Join(table.PrimaryKey, ","), table.Name, prefix.Sql()),
+		prefix.Values()...)
+	if err != nil {
+		return err
+	}
+	ids := make([]*primaryKey, 0)
+	for rows.Next() {
+		id := new(primaryKey)
+		err = rows.Scan(id.fields()[:len(table.PrimaryKey)]...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = tx.DeleteVersioned(table.Name, author, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreVersioned restores the last version of a deleted row preceding its deletion.
+// kvPairs should point to the update struct corresponding to the table.
+func (tx *Tx) RestoreVersioned(table string, author user.Name, id rowKey, kvPairs interface{}) error {
+	var v sql.NullInt64
+	err := tx.QueryRow(fmt.Sprintf("select max(%s) from %s where %s and editType!=?",
+		version(table), history(table), id.Sql()), append(id.Values(), string(content.EditDelete))...).Scan(&v)
+	if err != nil {
+		return err
+	}
+	if !v.Valid {
+		return content.ErrNotFound
+	}
+
+	err = tx.scanVersioned(table, id, int(v.Int64), kvPairs)
+	if err != nil {
+		return err
+	}
+	return tx.InsertOrUpdateVersioned(table, author, id, kvPairs)
+}
+
+// restoreVersionedAll restores all rows of the given table whose primary key starts with prefix,
+// and which were deleted by the transaction of the given sequence number.
+func (tx *Tx) restoreVersionedAll(table *database.Table, author user.Name, prefix *primaryKey, seq int64, newKvPairs func() interface{}) error {
+	match := make([]string, len(table.PrimaryKey))
+	for i, key := range table.PrimaryKey {
+		match[i] = fmt.Sprintf("%s=h.%s", key, key)
+	}
+	rows, err := tx.Query(fmt.Sprintf("select %s from %s h where %s and editType=? and seq=? and %s=(select max(%s) from %s where %s)",
+		strings.Join(table.PrimaryKey, ","), history(table.Name), prefix.Sql(), version(table.Name),
+		version(table.Name), history(table.Name), strings.Join(match, " and ")),
+		append(prefix.Values(), string(content.EditDelete), seq)...)
+	if err != nil {
+		return err
+	}
+	ids := make([]*primaryKey, 0)
+	for rows.Next() {
+		id := new(primaryKey)
+		err = rows.Scan(id.fields()[:len(table.PrimaryKey)]...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = tx.RestoreVersioned(table.Name, author, id, newKvPairs())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) LatestVersion(table string, id rowKey) (*content.Version, error) {
 	row := tx.QueryRow(fmt.Sprintf("select max(%s) from %s where %s",
 		version(table), history(table), id.Sql()), id.Values()...)
 	var v sql.NullInt64
@@ -223,7 +502,7 @@ func (tx *Tx) LatestVersion(table string, id *primaryKey) (*content.Version, err
 	}
 
 	if v.Valid {
-		return tx.scanVersion(tx.QueryRow(fmt.Sprintf("select author, time, %s, editType from %s where %s and %s=?",
+		return scanVersion(tx.QueryRow(fmt.Sprintf("select author, time, %s, editType from %s where %s and %s=?",
 			version(table), history(table), id.Sql(), version(table)), append(id.Values(), v)...))
 	} else {
 		return &content.Version{
@@ -233,7 +512,7 @@ func (tx *Tx) LatestVersion(table string, id *primaryKey) (*content.Version, err
 	}
 }
 
-func (tx *Tx) scanVersion(s scanner) (*content.Version, error) {
+func scanVersion(s scanner) (*content.Version, error) {
 	v := new(content.Version)
 	var author, editType string
 	var date int64
@@ -246,3 +525,33 @@ func (tx *Tx) scanVersion(s scanner) (*content.Version, error) {
 	v.EditType = content.EditType(editType)
 	return v, nil
 }
+
+func columnNames(table *database.Table) []string {
+	names := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		names[i] = c.Field
+	}
+	return names
+}
+
+// liveQuery returns a query selecting the rows of the given table belonging to one extract, sorted by primary key.
+// The query argument is the extract id.
+func liveQuery(table *database.Table) string {
+	return fmt.Sprintf("select %s from %s where extractId=? order by %s",
+		strings.Join(columnNames(table), ", "), table.Name, strings.Join(table.PrimaryKey, ", "))
+}
+
+// historicQuery returns a query selecting the rows of the given table belonging to one extract,
+// as they were at a given point of history, sorted by primary key.
+// The point is given by the column orderedBy of history tables, time or seq.
+// The query arguments are the extract id and the value of orderedBy.
+func historicQuery(table *database.Table, orderedBy string) string {
+	match := make([]string, len(table.PrimaryKey))
+	for i, key := range table.PrimaryKey {
+		match[i] = fmt.Sprintf("%s=h.%s", key, key)
+	}
+	return fmt.Sprintf("select h.%s from %s h where h.extractId=? and h.editType!='%s' and h.%s=("+
+		"select max(%s) from %s where %s and %s<=?) order by h.%s",
+		strings.Join(columnNames(table), ", h."), history(table.Name), content.EditDelete, version(table.Name),
+		version(table.Name), history(table.Name), strings.Join(match, " and "), orderedBy, strings.Join(table.PrimaryKey, ", h."))
+}
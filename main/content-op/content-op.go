@@ -0,0 +1,226 @@
+// Package main contains the content-op executable, which runs maintenance operations on a live content server.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/operations"
+	"github.com/polyglottis/platform/config"
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/language"
+)
+
+// errUsage is returned by commands called with wrong arguments.
+var errUsage = errors.New("wrong arguments")
+
+type command struct {
+	usage string
+	run   func(c *operations.Client, args []string) error
+}
+
+var commands = map[string]*command{
+	"backup": {
+		usage: "[-keep n] <dir> writes a backup of the database into dir, on the server, keeping the n most recent ones",
+		run: func(c *operations.Client, args []string) error {
+			flags := flag.NewFlagSet("backup", flag.ExitOnError)
+			keep := flags.Int("keep", 0, "number of backups to keep, 0 for all")
+			flags.Parse(args)
+			if flags.NArg() != 1 {
+				return errUsage
+			}
+			info, err := c.Backup(flags.Arg(0), *keep)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s (%d bytes, sha256 %s)\n", info.File, info.Size, info.Sha256)
+			return nil
+		},
+	},
+	"check": {
+		usage: "[-repair] checks the integrity of the database, and repairs what can be safely repaired with -repair",
+		run: func(c *operations.Client, args []string) error {
+			flags := flag.NewFlagSet("check", flag.ExitOnError)
+			repair := flags.Bool("repair", false, "repair problems")
+			flags.Parse(args)
+			problems, err := c.CheckIntegrity(*repair)
+			if err != nil {
+				return err
+			}
+			for _, p := range problems {
+				fmt.Printf("%s: %s %s", p.Kind, p.Table, p.Key)
+				if len(p.Detail) != 0 {
+					fmt.Printf(" (%s)", p.Detail)
+				}
+				if p.Repaired {
+					fmt.Print(" repaired")
+				}
+				fmt.Println()
+			}
+			return nil
+		},
+	},
+	"migrations": {
+		usage: "[-dry-run] [file] lists the schema migrations of the live database, or of a database file on the server",
+		run: func(c *operations.Client, args []string) error {
+			flags := flag.NewFlagSet("migrations", flag.ExitOnError)
+			dryRun := flags.Bool("dry-run", false, "try the pending migrations of file, and roll them back")
+			flags.Parse(args)
+			if flags.NArg() > 1 || (*dryRun && flags.NArg() == 0) {
+				return errUsage
+			}
+			statuses, err := c.Migrations(flags.Arg(0), *dryRun)
+			if err != nil {
+				return err
+			}
+			for _, m := range statuses {
+				fmt.Printf("%4d %s: ", m.Id, m.Name)
+				switch {
+				case len(m.Error) != 0:
+					fmt.Println("failed:", m.Error)
+				case m.Applied.IsZero():
+					fmt.Println("pending")
+				default:
+					fmt.Println("applied", m.Applied.Format(time.RFC3339))
+				}
+			}
+			return nil
+		},
+	},
+	"ping": {
+		usage: "checks that the operations server answers",
+		run: func(c *operations.Client, args []string) error {
+			return c.Ping()
+		},
+	},
+	"reindex": {
+		usage: "rebuilds the full-text search index",
+		run: func(c *operations.Client, args []string) error {
+			return c.RebuildSearchIndex()
+		},
+	},
+	"restore": {
+		usage: "<file> replaces the content of the database with a backup file, on the server",
+		run: func(c *operations.Client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return c.Restore(args[0])
+		},
+	},
+	"slug-cache": {
+		usage: "rebuilds the slug cache of the content server",
+		run: func(c *operations.Client, args []string) error {
+			return c.RebuildSlugCache()
+		},
+	},
+	"slug-collisions": {
+		usage: "[-fix] lists slugs used by several extracts, and renames them with -fix",
+		run: func(c *operations.Client, args []string) error {
+			flags := flag.NewFlagSet("slug-collisions", flag.ExitOnError)
+			fix := flags.Bool("fix", false, "rename colliding slugs")
+			flags.Parse(args)
+			collisions, err := c.SlugCollisions(*fix)
+			if err != nil {
+				return err
+			}
+			for _, col := range collisions {
+				fmt.Printf("%s: %v", col.Slug, col.ExtractIds)
+				if len(col.AliasOf) != 0 {
+					fmt.Printf(" (alias of %v)", col.AliasOf)
+				}
+				if len(col.Renamed) != 0 {
+					fmt.Printf(" renamed %v", col.Renamed)
+				}
+				fmt.Println()
+			}
+			return nil
+		},
+	},
+	"stats": {
+		usage: "reports the size of the database and of the slug cache",
+		run: func(c *operations.Client, args []string) error {
+			stats, err := c.Stats()
+			if err != nil {
+				return err
+			}
+			printCounts := func(name string, counts *database.Counts) {
+				fmt.Printf("%-24s %8d extracts %8d flavors %10d units\n", name, counts.Extracts, counts.Flavors, counts.Units)
+			}
+			printCounts("total", &stats.Counts)
+			langs := make([]string, 0, len(stats.ByLanguage))
+			for lang := range stats.ByLanguage {
+				langs = append(langs, string(lang))
+			}
+			sort.Strings(langs)
+			for _, lang := range langs {
+				printCounts("language "+lang, stats.ByLanguage[language.Code(lang)])
+			}
+			fTypes := make([]string, 0, len(stats.ByFlavorType))
+			for fType := range stats.ByFlavorType {
+				fTypes = append(fTypes, string(fType))
+			}
+			sort.Strings(fTypes)
+			for _, fType := range fTypes {
+				printCounts("flavor type "+fType, stats.ByFlavorType[content.FlavorType(fType)])
+			}
+			tables := make([]string, 0, len(stats.HistoryRows))
+			for table := range stats.HistoryRows {
+				tables = append(tables, table)
+			}
+			sort.Strings(tables)
+			for _, table := range tables {
+				fmt.Printf("%-24s %8d rows\n", "history of "+table, stats.HistoryRows[table])
+			}
+			fmt.Printf("file size %d bytes, %d pages of %d bytes, %d free pages\n",
+				stats.FileSize, stats.PageCount, stats.PageSize, stats.FreelistCount)
+			fmt.Printf("slug cache: %d slugs, %d former slugs, built %v, last rebuilt %v ago\n",
+				stats.SlugCacheSlugs, stats.SlugCacheAliases, stats.SlugCacheBuilt, stats.SlugCacheAge.Round(time.Second))
+			return nil
+		},
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: content-op <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	c, err := operations.NewClient(config.Get().ContentOp)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer c.Close()
+
+	err = cmd.run(c, os.Args[2:])
+	if err == errUsage {
+		usage()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
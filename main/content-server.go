@@ -2,16 +2,20 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"github.com/polyglottis/content_server/database"
 	"github.com/polyglottis/content_server/operations"
 	"github.com/polyglottis/content_server/server"
+	"github.com/polyglottis/content_server/versioned"
 	"github.com/polyglottis/platform/config"
 	"github.com/polyglottis/rpc"
 )
 
 func main() {
+	versionedAddr := flag.String("versioned", "", "address of the rpc server for versioned reads and conditional updates, none if empty")
+	flag.Parse()
 
 	c := config.Get()
 
@@ -20,8 +24,9 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	main := server.New(server.NewServerDB(db), c.Content)
-	op := operations.NewOpServer(db, c.ContentOp)
+	s := server.NewServerDB(db)
+	main := server.New(s, c.Content)
+	op := operations.NewOpServer(s, c.ContentOp)
 	p := rpc.NewServerPair("Content Server", main, op)
 
 	err = p.RegisterAndListen()
@@ -30,5 +35,15 @@ func main() {
 	}
 	defer p.Close()
 
+	if len(*versionedAddr) != 0 {
+		v := versioned.NewVersionedServer(s, *versionedAddr)
+		err = v.RegisterAndListen()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer v.Close()
+		go v.Accept()
+	}
+
 	p.Accept()
 }
@@ -3,6 +3,9 @@ package operations
 
 import (
 	"net/rpc"
+
+	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/server"
 )
 
 type Client struct {
@@ -17,3 +20,83 @@ func NewClient(addr string) (*Client, error) {
 	}
 	return &Client{c: c}, nil
 }
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+// Ping checks that the operations server answers.
+func (c *Client) Ping() error {
+	var nothing bool
+	return c.c.Call("OpRpcServer.DoNothing", false, &nothing)
+}
+
+// SlugCollisions lists slugs used by several extracts, and fixes them if fix is true.
+func (c *Client) SlugCollisions(fix bool) ([]*database.SlugCollision, error) {
+	var collisions []*database.SlugCollision
+	err := c.c.Call("OpRpcServer.SlugCollisions", fix, &collisions)
+	if err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+// RebuildSearchIndex rebuilds the full-text search index from the units.
+func (c *Client) RebuildSearchIndex() error {
+	var nothing bool
+	return c.c.Call("OpRpcServer.RebuildSearchIndex", false, &nothing)
+}
+
+// RebuildSlugCache reloads the slug cache of the content server from the database.
+func (c *Client) RebuildSlugCache() error {
+	var nothing bool
+	return c.c.Call("OpRpcServer.RebuildSlugCache", false, &nothing)
+}
+
+// Backup writes a snapshot of the live database into a new file of directory dir, on the content server machine.
+// If keep is positive, only the keep most recent backups are kept.
+func (c *Client) Backup(dir string, keep int) (*database.BackupInfo, error) {
+	info := new(database.BackupInfo)
+	err := c.c.Call("OpRpcServer.Backup", BackupArgs{Dir: dir, Keep: keep}, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Restore replaces the content of the live database with the content of a backup file, on the content server machine.
+func (c *Client) Restore(file string) error {
+	var nothing bool
+	return c.c.Call("OpRpcServer.Restore", file, &nothing)
+}
+
+// CheckIntegrity reports inconsistencies of the database, and repairs what can be safely repaired if repair is true.
+func (c *Client) CheckIntegrity(repair bool) ([]*database.IntegrityProblem, error) {
+	var problems []*database.IntegrityProblem
+	err := c.c.Call("OpRpcServer.CheckIntegrity", repair, &problems)
+	if err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// Stats reports the size of the database and of the slug cache.
+func (c *Client) Stats() (*server.Stats, error) {
+	stats := new(server.Stats)
+	err := c.c.Call("OpRpcServer.Stats", false, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Migrations lists the schema migrations of the live database if file is empty,
+// or of a database file on the content server machine. With dryRun, pending migrations of file are tried and rolled back.
+func (c *Client) Migrations(file string, dryRun bool) ([]*database.MigrationStatus, error) {
+	var statuses []*database.MigrationStatus
+	err := c.c.Call("OpRpcServer.Migrations", MigrationArgs{File: file, DryRun: dryRun}, &statuses)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
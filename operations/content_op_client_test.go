@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/server"
 )
 
 var file = "content_test.db"
@@ -13,14 +14,14 @@ var testAddr = ":1234"
 func TestClientOperationServer(t *testing.T) {
 
 	os.Remove(file)
-	db, err := database.Open(file)
+	s, err := server.NewServer(file)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer s.Close()
 	defer os.Remove(file)
 
-	op := NewOpServer(db, testAddr)
+	op := NewOpServer(s, testAddr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,4 +41,46 @@ func TestClientOperationServer(t *testing.T) {
 	if c == nil {
 		t.Fatal("Client should not be nil")
 	}
+	defer c.Close()
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	collisions, err := c.SlugCollisions(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collisions) != 0 {
+		t.Errorf("Expected no slug collisions, got %v", collisions)
+	}
+	problems, err := c.CheckIntegrity(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no integrity problems, got %v", problems)
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Extracts != 0 || !stats.SlugCacheBuilt {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	migrations, err := c.Migrations("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.Applied.IsZero() {
+			t.Errorf("Migration %d should have been applied", m.Id)
+		}
+	}
+	if err := c.RebuildSlugCache(); err != nil {
+		t.Error(err)
+	}
+	// Errors lose their identity over rpc.
+	if err := c.RebuildSearchIndex(); err != nil && err.Error() != database.ErrSearchUnavailable.Error() {
+		t.Error(err)
+	}
 }
@@ -2,17 +2,99 @@ package operations
 
 import (
 	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/server"
 	"github.com/polyglottis/rpc"
 )
 
 type OpRpcServer struct {
-	db *database.DB
+	s *server.Server
 }
 
-func NewOpServer(db *database.DB, addr string) *rpc.Server {
-	return rpc.NewServer("OpRpcServer", &OpRpcServer{db}, addr)
+func NewOpServer(s *server.Server, addr string) *rpc.Server {
+	return rpc.NewServer("OpRpcServer", &OpRpcServer{s}, addr)
 }
 
 func (s *OpRpcServer) DoNothing(nothing bool, nothing_too *bool) error {
 	return nil
 }
+
+// SlugCollisions reports slugs used by several extracts, and fixes them if fix is true.
+func (s *OpRpcServer) SlugCollisions(fix bool, collisions *[]*database.SlugCollision) error {
+	var err error
+	if !fix {
+		*collisions, err = s.s.SlugCollisions()
+		return err
+	}
+	*collisions, err = s.s.FixSlugCollisions()
+	return err
+}
+
+// RebuildSearchIndex rebuilds the full-text search index from the units.
+func (s *OpRpcServer) RebuildSearchIndex(nothing bool, nothing_too *bool) error {
+	return s.s.RebuildSearchIndex()
+}
+
+// RebuildSlugCache reloads the slug cache of the content server from the database.
+func (s *OpRpcServer) RebuildSlugCache(nothing bool, nothing_too *bool) error {
+	return s.s.RebuildSlugCache()
+}
+
+// BackupArgs are the arguments of Backup.
+type BackupArgs struct {
+	// Dir is the backup directory, on the content server machine.
+	Dir string
+	// Keep is the number of backups kept in Dir, or zero to keep them all.
+	Keep int
+}
+
+// Backup writes a consistent snapshot of the live database into a new file of the backup directory.
+func (s *OpRpcServer) Backup(args BackupArgs, info *database.BackupInfo) error {
+	b, err := s.s.Backup(args.Dir, args.Keep)
+	if err != nil {
+		return err
+	}
+	*info = *b
+	return nil
+}
+
+// Restore replaces the content of the live database with the content of a backup file, on the content server machine.
+func (s *OpRpcServer) Restore(file string, nothing *bool) error {
+	return s.s.Restore(file)
+}
+
+// CheckIntegrity reports inconsistencies of the database, and repairs what can be safely repaired if repair is true.
+func (s *OpRpcServer) CheckIntegrity(repair bool, problems *[]*database.IntegrityProblem) error {
+	var err error
+	*problems, err = s.s.CheckIntegrity(repair)
+	return err
+}
+
+// Stats reports the size of the database and of the slug cache.
+func (s *OpRpcServer) Stats(nothing bool, stats *server.Stats) error {
+	st, err := s.s.Stats()
+	if err != nil {
+		return err
+	}
+	*stats = *st
+	return nil
+}
+
+// MigrationArgs are the arguments of Migrations.
+type MigrationArgs struct {
+	// File is a database file on the content server machine, or empty for the live database.
+	File string
+	// DryRun tries the pending migrations of File, and rolls them back.
+	DryRun bool
+}
+
+// Migrations lists the schema migrations of the live database, or of a database file.
+// The live database is migrated when opened, so its migrations should all be applied.
+func (s *OpRpcServer) Migrations(args MigrationArgs, statuses *[]*database.MigrationStatus) error {
+	var err error
+	if len(args.File) == 0 {
+		*statuses, err = s.s.Migrations()
+	} else {
+		*statuses, err = database.PendingMigrations(args.File, args.DryRun)
+	}
+	return err
+}
@@ -2,9 +2,8 @@
 package server
 
 import (
+	"context"
 	"log"
-	"strings"
-	"sync"
 
 	"github.com/polyglottis/content_server/database"
 	"github.com/polyglottis/platform/content"
@@ -19,13 +18,14 @@ func New(server *Server, addr string) *rpc.Server {
 }
 
 func NewServerDB(db *database.DB) *Server {
-	return &Server{
-		DB: db,
-		slugToId: &slugToId{
-			shouldRebuild: true,
-			Mutex:         new(sync.Mutex),
-		},
+	s := &Server{
+		DB:       db,
+		slugToId: newSlugToId(),
 	}
+	if err := s.RebuildSlugCache(); err != nil {
+		log.Println("Error: could not build slugToId map:", err)
+	}
+	return s
 }
 
 func NewServer(dbFile string) (*Server, error) {
@@ -41,51 +41,135 @@ type Server struct {
 	slugToId *slugToId
 }
 
-type slugToId struct {
-	m             map[string]content.ExtractId
-	shouldRebuild bool
-	*sync.Mutex
+func (s *Server) NewExtract(author user.Name, e *content.Extract) error {
+	return s.NewExtractContext(context.Background(), author, e)
 }
 
-func (s *Server) NewExtract(author user.Name, e *content.Extract) error {
-	err := s.DB.NewExtract(author, e)
+func (s *Server) NewExtractContext(ctx context.Context, author user.Name, e *content.Extract) error {
+	err := s.DB.NewExtractContext(ctx, author, e)
 	if err == nil {
-		s.slugToId.shouldRebuild = true
+		s.refreshSlug(e.Id)
 	}
 	return err
 }
 
 func (s *Server) UpdateExtract(author user.Name, e *content.Extract) error {
-	err := s.DB.UpdateExtract(author, e)
+	return s.UpdateExtractContext(context.Background(), author, e)
+}
+
+func (s *Server) UpdateExtractContext(ctx context.Context, author user.Name, e *content.Extract) error {
+	// UpdateExtract never changes the slug, so the slug cache stays valid.
+	return s.DB.UpdateExtractContext(ctx, author, e)
+}
+
+func (s *Server) DeleteExtract(author user.Name, id content.ExtractId) error {
+	return s.DeleteExtractContext(context.Background(), author, id)
+}
+
+func (s *Server) DeleteExtractContext(ctx context.Context, author user.Name, id content.ExtractId) error {
+	err := s.DB.DeleteExtractContext(ctx, author, id)
+	if err == nil {
+		s.refreshSlug(id)
+	}
+	return err
+}
+
+func (s *Server) RestoreExtract(author user.Name, id content.ExtractId) error {
+	return s.RestoreExtractContext(context.Background(), author, id)
+}
+
+func (s *Server) RestoreExtractContext(ctx context.Context, author user.Name, id content.ExtractId) error {
+	err := s.DB.RestoreExtractContext(ctx, author, id)
+	if err == nil {
+		s.refreshSlug(id)
+	}
+	return err
+}
+
+func (s *Server) RenameSlug(author user.Name, id content.ExtractId, newSlug string) error {
+	return s.RenameSlugContext(context.Background(), author, id, newSlug)
+}
+
+func (s *Server) RenameSlugContext(ctx context.Context, author user.Name, id content.ExtractId, newSlug string) error {
+	err := s.DB.RenameSlugContext(ctx, author, id, newSlug)
 	if err == nil {
-		s.slugToId.shouldRebuild = true
+		s.refreshSlug(id)
 	}
 	return err
 }
 
+// Restore replaces the content of the database with the content of a backup file, and rebuilds the slug cache.
+func (s *Server) Restore(file string) error {
+	return s.RestoreContext(context.Background(), file)
+}
+
+func (s *Server) RestoreContext(ctx context.Context, file string) error {
+	err := s.DB.RestoreContext(ctx, file)
+	if err != nil {
+		return err
+	}
+	return s.RebuildSlugCache()
+}
+
+// FixSlugCollisions resolves all slug collisions, and rebuilds the slug cache.
+func (s *Server) FixSlugCollisions() ([]*database.SlugCollision, error) {
+	return s.FixSlugCollisionsContext(context.Background())
+}
+
+func (s *Server) FixSlugCollisionsContext(ctx context.Context) ([]*database.SlugCollision, error) {
+	collisions, err := s.DB.FixSlugCollisionsContext(ctx)
+	return collisions, s.rebuildSlugCacheAfter(err)
+}
+
+// CheckIntegrity scans the whole database for inconsistencies.
+// If repair is true, the problems which can be fixed safely are fixed, and the slug cache is rebuilt.
+func (s *Server) CheckIntegrity(repair bool) ([]*database.IntegrityProblem, error) {
+	problems, err := s.DB.CheckIntegrity(repair)
+	if !repair {
+		return problems, err
+	}
+	return problems, s.rebuildSlugCacheAfter(err)
+}
+
 func (s *Server) GetExtractId(slug string) (content.ExtractId, error) {
-	var id content.ExtractId
-	s.withSlugToId(func(m map[string]content.ExtractId) {
-		id = m[strings.ToLower(slug)]
-	})
-	if len(id) == 0 {
+	id, ok := s.slugToId.get(slug)
+	if !ok && !s.slugToId.isBuilt() {
+		// the initial build failed, try again
+		if err := s.RebuildSlugCache(); err != nil {
+			return "", err
+		}
+		id, ok = s.slugToId.get(slug)
+	}
+	if !ok {
 		return "", content.ErrNotFound
-	} else {
-		return id, nil
 	}
+	return id, nil
+}
+
+// RebuildSlugCache reloads the whole slug cache from the database.
+func (s *Server) RebuildSlugCache() error {
+	return s.slugToId.rebuild(s.DB)
 }
 
-func (s *Server) withSlugToId(f func(map[string]content.ExtractId)) {
-	s.slugToId.Lock()
-	defer s.slugToId.Unlock()
-	if s.slugToId.shouldRebuild {
-		m, err := s.SlugToIdMap()
+// rebuildSlugCacheAfter rebuilds the slug cache after an operation renaming slugs, whether it failed or not:
+// renames are committed one by one, so a failure may come after some of them.
+// It returns the error of the operation, if any.
+func (s *Server) rebuildSlugCacheAfter(err error) error {
+	if rebuildErr := s.RebuildSlugCache(); rebuildErr != nil {
+		s.slugToId.invalidate()
 		if err == nil {
-			s.slugToId.m = m
-			s.slugToId.shouldRebuild = false
-		} else {
-			log.Println("Error: could not rebuild slugToId map:", err)
+			return rebuildErr
 		}
+		log.Println("Error: could not rebuild slug cache:", rebuildErr)
+	}
+	return err
+}
+
+// refreshSlug updates the slug cache entry of one extract after a write.
+func (s *Server) refreshSlug(id content.ExtractId) {
+	err := s.slugToId.refresh(id, s.DB)
+	if err != nil {
+		log.Println("Error: could not refresh slug of extract", id, err)
+		s.slugToId.invalidate()
 	}
-	f(s.slugToId.m)
 }
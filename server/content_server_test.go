@@ -1,9 +1,12 @@
 package server
 
 import (
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/polyglottis/platform/content"
 	"github.com/polyglottis/platform/content/test"
 )
 
@@ -26,3 +29,205 @@ func TestAll(t *testing.T) {
 	tester := test.NewTester(s, t)
 	tester.All()
 }
+
+// newExtract creates an extract with the given slug through the server, and returns its id.
+func newExtract(t *testing.T, s *Server, slug string) content.ExtractId {
+	e := &content.Extract{
+		UrlSlug: slug,
+		Type:    "story",
+		Flavors: content.FlavorMap{"en": content.FlavorByType{"text": {{
+			Blocks: content.BlockSlice{{{Content: "Title of " + slug}}},
+		}}}},
+	}
+	err := s.NewExtract("tester", e)
+	if err != nil {
+		t.Error(err)
+	}
+	return e.Id
+}
+
+func TestSlugCache(t *testing.T) {
+	os.Remove(testDB)
+
+	s, err := NewServer(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.Remove(testDB)
+
+	const n = 10
+	ids := make([]content.ExtractId, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = newExtract(t, s, fmt.Sprintf("Slug%d", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			s.GetExtractId(fmt.Sprintf("slug%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		id, err := s.GetExtractId(fmt.Sprintf("SLUG%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != ids[i] {
+			t.Errorf("Expected %s, got %s", ids[i], id)
+		}
+	}
+
+	// Rename even extracts and delete odd ones, while reading.
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				err = s.RenameSlug("tester", ids[i], fmt.Sprintf("renamed%d", i))
+			} else {
+				err = s.DeleteExtract("tester", ids[i])
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			s.GetExtractId(fmt.Sprintf("slug%d", i))
+			s.GetExtractId(fmt.Sprintf("renamed%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		for _, slug := range []string{fmt.Sprintf("slug%d", i), fmt.Sprintf("Renamed%d", i)} {
+			id, err := s.GetExtractId(slug)
+			switch {
+			case i%2 == 0 && (err != nil || id != ids[i]):
+				t.Errorf("Slug %s should resolve to %s, got %v, %v", slug, ids[i], id, err)
+			case i%2 == 1 && err != content.ErrNotFound:
+				t.Errorf("Slug %s of a deleted extract should not be found, got %v, %v", slug, id, err)
+			}
+		}
+	}
+
+	err = s.RestoreExtract("tester", ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.GetExtractId("slug3"); err != nil || id != ids[3] {
+		t.Errorf("Restored extract should be found, got %v, %v", id, err)
+	}
+
+	info, err := s.Backup(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := newExtract(t, s, "extra")
+	err = s.RenameSlug("tester", ids[0], "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Restore(info.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.GetExtractId("extra"); err != content.ErrNotFound {
+		t.Errorf("Slug of extract %s created after the backup should not be found, got %v, %v", extra, id, err)
+	}
+	if id, err := s.GetExtractId("slug0"); err != nil || id != ids[0] {
+		t.Errorf("Restore should bring slug0 back, got %v, %v", id, err)
+	}
+}
+
+func TestRenameSlug(t *testing.T) {
+	os.Remove(testDB)
+
+	s, err := NewServer(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.Remove(testDB)
+
+	id1 := newExtract(t, s, "old-slug")
+	err = s.RenameSlug("tester", id1, "new-slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, slug := range []string{"old-slug", "NEW-slug"} {
+		if id, err := s.GetExtractId(slug); err != nil || id != id1 {
+			t.Errorf("Slug %s should resolve to %s, got %v, %v", slug, id1, id, err)
+		}
+	}
+
+	err = s.RebuildSlugCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.GetExtractId("old-slug"); err != nil || id != id1 {
+		t.Errorf("Former slug should resolve after a rebuild, got %v, %v", id, err)
+	}
+
+	// Maintenance operations rebuild the cache, which renames bypassing the server leave stale.
+	for _, slug := range []string{"fixed-slug", "checked-slug"} {
+		err = s.DB.RenameSlug("tester", id1, slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slug == "fixed-slug" {
+			_, err = s.FixSlugCollisions()
+		} else {
+			_, err = s.CheckIntegrity(true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := s.GetExtractId(slug); err != nil || id != id1 {
+			t.Errorf("Slug %s should resolve after maintenance, got %v, %v", slug, id, err)
+		}
+	}
+
+	err = s.DeleteExtract("tester", id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetExtractId("old-slug"); err != content.ErrNotFound {
+		t.Errorf("Former slug of a deleted extract should not resolve, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	os.Remove(testDB)
+
+	s, err := NewServer(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.Remove(testDB)
+
+	newExtract(t, s, "slug-a")
+	b := newExtract(t, s, "slug-b")
+	err = s.RenameSlug("tester", b, "slug-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Extracts != 2 || stats.SlugCacheSlugs != 2 || stats.SlugCacheAliases != 1 || !stats.SlugCacheBuilt {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.SlugCacheAge <= 0 {
+		t.Errorf("Expected the slug cache to have been built, got age %v", stats.SlugCacheAge)
+	}
+}
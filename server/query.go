@@ -1,34 +1,31 @@
 package server
 
 import (
+	"github.com/polyglottis/content_server/database"
 	"github.com/polyglottis/platform/content"
 )
 
+// ExtractsMatching lists the ids of all extracts matching q, sorted by slug.
 func (s *Server) ExtractsMatching(q *content.Query) ([]content.ExtractId, error) {
-	var extracts []*content.Extract
-	var err error
-	switch {
-	case q.LanguageA == "" && q.LanguageB == "":
-		extracts, err = s.ExtractList()
-	case q.LanguageA != "" && q.LanguageB != "":
-		extracts, err = s.ExtractListWithLanguages(q.LanguageA, q.LanguageB)
-	default: // exactly one of q.LanguageA or q.LanguageB is non-empty
-		extracts, err = s.ExtractListWithLanguage(q.LanguageA + q.LanguageB)
-	}
+	page, err := s.ExtractsMatchingPage(q, nil)
 	if err != nil {
 		return nil, err
 	}
-	ids := make([]content.ExtractId, 0, len(extracts))
-	if q.ExtractType == "" {
-		for _, e := range extracts {
-			ids = append(ids, e.Id)
-		}
-	} else {
-		for _, e := range extracts {
-			if e.Type == q.ExtractType {
-				ids = append(ids, e.Id)
-			}
-		}
-	}
-	return ids, nil
+	return page.Ids, nil
+}
+
+// ExtractsMatchingPage lists the ids of the extracts matching q, in the order and window given by opts.
+func (s *Server) ExtractsMatchingPage(q *content.Query, opts *database.ListOptions) (*database.ExtractPage, error) {
+	return s.ExtractsMatchingFilter(database.QueryFilter(q), opts)
+}
+
+// ExtractsMatchingFilter lists the ids of the extracts matching f, including its metadata conditions,
+// in the order and window given by opts.
+func (s *Server) ExtractsMatchingFilter(f *database.ExtractFilter, opts *database.ListOptions) (*database.ExtractPage, error) {
+	return s.FilteredExtractsPage(f, opts)
+}
+
+// FacetsMatching counts the extracts matching q, per language, language pair, extract type and flavor type.
+func (s *Server) FacetsMatching(q *content.Query) (*database.Facets, error) {
+	return s.Facets(database.QueryFilter(q))
 }
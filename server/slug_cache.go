@@ -0,0 +1,154 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polyglottis/platform/content"
+)
+
+// slugToId caches the mapping from lowercase slugs (current or former) to extract ids.
+// It is built once, then updated extract by extract after each write.
+type slugToId struct {
+	sync.RWMutex
+	// loading serializes loads from the database, so that they are applied in order,
+	// without blocking readers while the database is queried.
+	loading   sync.Mutex
+	m         map[string]content.ExtractId
+	slugs     map[content.ExtractId]string // reverse mapping of m
+	aliases   map[string]content.ExtractId // former slugs
+	aliasesOf map[content.ExtractId][]string
+	built     bool
+	rebuilt   time.Time // time of the last rebuild
+}
+
+// slugSource is where the slug cache is loaded from.
+type slugSource interface {
+	SlugToIdMap() (map[string]content.ExtractId, error)
+	SlugAliasMap() (map[string]content.ExtractId, error)
+	ExtractSlug(id content.ExtractId) (string, error)
+	ExtractSlugAliases(id content.ExtractId) ([]string, error)
+}
+
+func newSlugToId() *slugToId {
+	return &slugToId{
+		m:         make(map[string]content.ExtractId),
+		slugs:     make(map[content.ExtractId]string),
+		aliases:   make(map[string]content.ExtractId),
+		aliasesOf: make(map[content.ExtractId][]string),
+	}
+}
+
+// get looks up a slug. Current slugs take precedence over former slugs,
+// and former slugs of deleted extracts are ignored.
+func (c *slugToId) get(slug string) (content.ExtractId, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	slug = strings.ToLower(slug)
+	if id, ok := c.m[slug]; ok {
+		return id, true
+	}
+	if id, ok := c.aliases[slug]; ok {
+		_, live := c.slugs[id]
+		return id, live
+	}
+	return "", false
+}
+
+func (c *slugToId) isBuilt() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.built
+}
+
+func (c *slugToId) rebuild(src slugSource) error {
+	c.loading.Lock()
+	defer c.loading.Unlock()
+	m, err := src.SlugToIdMap()
+	if err != nil {
+		return err
+	}
+	aliases, err := src.SlugAliasMap()
+	if err != nil {
+		return err
+	}
+	slugs := make(map[content.ExtractId]string, len(m))
+	for slug, id := range m {
+		slugs[id] = slug
+	}
+	aliasesOf := make(map[content.ExtractId][]string)
+	for slug, id := range aliases {
+		aliasesOf[id] = append(aliasesOf[id], slug)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.m = m
+	c.slugs = slugs
+	c.aliases = aliases
+	c.aliasesOf = aliasesOf
+	c.built = true
+	c.rebuilt = time.Now()
+	return nil
+}
+
+// refresh reloads the slugs of one extract.
+// Loads are serialized, so that concurrent refreshes of the same extract
+// leave the cache in the state of the latest one.
+func (c *slugToId) refresh(id content.ExtractId, src slugSource) error {
+	c.loading.Lock()
+	defer c.loading.Unlock()
+	slug, err := src.ExtractSlug(id)
+	if err != nil && err != content.ErrNotFound {
+		return err
+	}
+	aliases, err := src.ExtractSlugAliases(id)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.remove(id)
+	if len(slug) != 0 {
+		slug = strings.ToLower(slug)
+		c.m[slug] = id
+		c.slugs[id] = slug
+	}
+	for _, alias := range aliases {
+		c.aliases[alias] = id
+	}
+	c.aliasesOf[id] = aliases
+	return nil
+}
+
+// remove drops the slugs of an extract. c must be locked.
+func (c *slugToId) remove(id content.ExtractId) {
+	if slug, ok := c.slugs[id]; ok {
+		if c.m[slug] == id {
+			delete(c.m, slug)
+		}
+		delete(c.slugs, id)
+	}
+	for _, alias := range c.aliasesOf[id] {
+		if c.aliases[alias] == id {
+			delete(c.aliases, alias)
+		}
+	}
+	delete(c.aliasesOf, id)
+}
+
+// size returns the number of current and former slugs in the cache, and the time of the last rebuild.
+func (c *slugToId) size() (slugs, aliases int, rebuilt time.Time) {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m), len(c.aliases), c.rebuilt
+}
+
+// invalidate marks the cache for a full rebuild on the next cache miss.
+func (c *slugToId) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.built = false
+}
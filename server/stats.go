@@ -0,0 +1,34 @@
+package server
+
+import (
+	"time"
+
+	"github.com/polyglottis/content_server/database"
+)
+
+// Stats describes the size of the database and of the slug cache.
+type Stats struct {
+	database.Stats
+	SlugCacheSlugs   int
+	SlugCacheAliases int
+	// SlugCacheAge is the time since the last rebuild of the slug cache, or zero if it was never built.
+	SlugCacheAge time.Duration
+	// SlugCacheBuilt is false if the cache was invalidated, and is rebuilt on the next miss.
+	SlugCacheBuilt bool
+}
+
+// Stats reports the size of the database and of the slug cache.
+func (s *Server) Stats() (*Stats, error) {
+	dbStats, err := s.DB.Stats()
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Stats: *dbStats}
+	var rebuilt time.Time
+	stats.SlugCacheSlugs, stats.SlugCacheAliases, rebuilt = s.slugToId.size()
+	if !rebuilt.IsZero() {
+		stats.SlugCacheAge = time.Since(rebuilt)
+	}
+	stats.SlugCacheBuilt = s.slugToId.isBuilt()
+	return stats, nil
+}
@@ -0,0 +1,68 @@
+// Package versioned contains an rpc client-server pair for reading extracts with their versions,
+// and for updating them unless they changed in the meantime.
+// Editors use it next to the content rpc client, whose extracts carry no versions.
+package versioned
+
+import (
+	"net/rpc"
+
+	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/user"
+)
+
+type Client struct {
+	c *rpc.Client
+}
+
+// NewClient creates an rpc client for versioned reads and conditional updates on the content server.
+func NewClient(addr string) (*Client, error) {
+	c, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c: c}, nil
+}
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+// GetExtractWithVersions returns an extract together with the versions to pass to conditional updates.
+func (c *Client) GetExtractWithVersions(id content.ExtractId) (*content.Extract, *database.Versions, error) {
+	e := new(ExtractWithVersions)
+	err := c.c.Call("VersionedRpcServer.GetExtractWithVersions", id, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.Extract, e.Versions, nil
+}
+
+// conditionalCall calls a conditional update, returning its conflict as a *database.VersionConflict error.
+func (c *Client) conditionalCall(method string, args interface{}) error {
+	result := new(ConditionalResult)
+	err := c.c.Call(method, args, result)
+	if err != nil {
+		return err
+	}
+	if result.Conflict != nil {
+		return result.Conflict
+	}
+	return nil
+}
+
+// UpdateExtractIfVersion updates an extract, or fails with a *database.VersionConflict if its latest version is not expected.
+func (c *Client) UpdateExtractIfVersion(author user.Name, e *content.Extract, expected int) error {
+	return c.conditionalCall("VersionedRpcServer.UpdateExtractIfVersion", ExtractUpdate{Author: author, Extract: e, Expected: expected})
+}
+
+// UpdateFlavorIfVersion updates a flavor, or fails with a *database.VersionConflict if its latest version is not expected.
+func (c *Client) UpdateFlavorIfVersion(author user.Name, f *content.Flavor, expected int) error {
+	return c.conditionalCall("VersionedRpcServer.UpdateFlavorIfVersion", FlavorUpdate{Author: author, Flavor: f, Expected: expected})
+}
+
+// InsertOrUpdateUnitsIfVersions inserts or updates units, or fails with a *database.VersionConflict
+// if the latest version of one of them is not the one in expected.
+func (c *Client) InsertOrUpdateUnitsIfVersions(author user.Name, units []*content.Unit, expected map[database.UnitKey]int) error {
+	return c.conditionalCall("VersionedRpcServer.InsertOrUpdateUnitsIfVersions", UnitsUpdate{Author: author, Units: units, Expected: expected})
+}
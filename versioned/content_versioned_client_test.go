@@ -0,0 +1,76 @@
+package versioned
+
+import (
+	"os"
+	"testing"
+
+	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/server"
+	"github.com/polyglottis/platform/content"
+)
+
+var file = "content_test.db"
+var testAddr = ":1235"
+
+func TestClientVersionedServer(t *testing.T) {
+
+	os.Remove(file)
+	s, err := server.NewServer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer os.Remove(file)
+
+	v := NewVersionedServer(s, testAddr)
+	err = v.RegisterAndListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go v.Accept()
+
+	c, err := NewClient(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	e := &content.Extract{
+		Type: "story",
+		Flavors: content.FlavorMap{"en": content.FlavorByType{"text": {{
+			Blocks: content.BlockSlice{{{Content: "A title"}}},
+		}}}},
+	}
+	err = s.NewExtract("tester", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, versions, err := c.GetExtractWithVersions(e.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UrlSlug != e.UrlSlug || versions.Extract != 0 || len(versions.Units) != 1 {
+		t.Errorf("Unexpected extract %+v with versions %+v", got, versions)
+	}
+	f := got.Flavors["en"]["text"][0]
+	f.Summary = "first"
+	err = c.UpdateFlavorIfVersion("tester", f, versions.Flavors[database.FlavorKey{Language: "en", Type: "text", Id: 1}])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Summary = "second"
+	err = c.UpdateFlavorIfVersion("other", f, 0)
+	if conflict, ok := err.(*database.VersionConflict); !ok || conflict.Current.Number != 1 || conflict.Current.Author != "tester" {
+		t.Errorf("Expected a version conflict, got %v", err)
+	}
+	err = c.InsertOrUpdateUnitsIfVersions("tester", f.Blocks[0], versions.Units)
+	if err != nil {
+		t.Error(err)
+	}
+	got.Type = "poem"
+	err = c.UpdateExtractIfVersion("tester", got, versions.Extract)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package versioned
+
+import (
+	"github.com/polyglottis/content_server/database"
+	"github.com/polyglottis/content_server/server"
+	"github.com/polyglottis/platform/content"
+	"github.com/polyglottis/platform/user"
+	"github.com/polyglottis/rpc"
+)
+
+type VersionedRpcServer struct {
+	s *server.Server
+}
+
+func NewVersionedServer(s *server.Server, addr string) *rpc.Server {
+	return rpc.NewServer("VersionedRpcServer", &VersionedRpcServer{s}, addr)
+}
+
+// ExtractWithVersions is an extract together with the versions to pass to conditional updates.
+type ExtractWithVersions struct {
+	Extract  *content.Extract
+	Versions *database.Versions
+}
+
+// GetExtractWithVersions returns an extract with its versions.
+func (s *VersionedRpcServer) GetExtractWithVersions(id content.ExtractId, e *ExtractWithVersions) error {
+	var err error
+	e.Extract, e.Versions, err = s.s.GetExtractWithVersions(id)
+	return err
+}
+
+// ConditionalResult is the result of a conditional update.
+// Conflicts are returned as results rather than errors, so that clients get them back typed.
+type ConditionalResult struct {
+	Conflict *database.VersionConflict
+}
+
+func conditionalResult(err error, result *ConditionalResult) error {
+	if conflict, ok := err.(*database.VersionConflict); ok {
+		result.Conflict = conflict
+		return nil
+	}
+	return err
+}
+
+// ExtractUpdate is the argument of UpdateExtractIfVersion.
+type ExtractUpdate struct {
+	Author   user.Name
+	Extract  *content.Extract
+	Expected int
+}
+
+// UpdateExtractIfVersion updates an extract, unless its latest version is not the expected one.
+func (s *VersionedRpcServer) UpdateExtractIfVersion(u ExtractUpdate, result *ConditionalResult) error {
+	return conditionalResult(s.s.UpdateExtractIfVersion(u.Author, u.Extract, u.Expected), result)
+}
+
+// FlavorUpdate is the argument of UpdateFlavorIfVersion.
+type FlavorUpdate struct {
+	Author   user.Name
+	Flavor   *content.Flavor
+	Expected int
+}
+
+// UpdateFlavorIfVersion updates a flavor, unless its latest version is not the expected one.
+func (s *VersionedRpcServer) UpdateFlavorIfVersion(u FlavorUpdate, result *ConditionalResult) error {
+	return conditionalResult(s.s.UpdateFlavorIfVersion(u.Author, u.Flavor, u.Expected), result)
+}
+
+// UnitsUpdate is the argument of InsertOrUpdateUnitsIfVersions.
+type UnitsUpdate struct {
+	Author   user.Name
+	Units    []*content.Unit
+	Expected map[database.UnitKey]int
+}
+
+// InsertOrUpdateUnitsIfVersions inserts or updates units, unless the latest version of one of them is not the expected one.
+func (s *VersionedRpcServer) InsertOrUpdateUnitsIfVersions(u UnitsUpdate, result *ConditionalResult) error {
+	return conditionalResult(s.s.InsertOrUpdateUnitsIfVersions(u.Author, u.Units, u.Expected), result)
+}